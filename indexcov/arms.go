@@ -0,0 +1,225 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// hg19Centromeres are from the UCSC gap table.
+var hg19Centromeres = map[string][2]int{
+	"1": {121535434, 124535434}, "2": {92326171, 95326171}, "3": {90504854, 93504854},
+	"4": {49660117, 52660117}, "5": {46405641, 49405641}, "6": {58830166, 61830166},
+	"7": {58054331, 61054331}, "8": {43838887, 46838887}, "9": {47367679, 50367679},
+	"10": {39254935, 42254935}, "11": {51644205, 54644205}, "12": {34856694, 37856694},
+	"13": {16000000, 19000000}, "14": {16000000, 19000000}, "15": {17000000, 20000000},
+	"16": {35335801, 38335801}, "17": {22263006, 25263006}, "18": {15460898, 18460898},
+	"19": {24681782, 27681782}, "20": {26369569, 29369569}, "21": {11288129, 14288129},
+	"22": {13000000, 16000000}, "X": {58632012, 61632012}, "Y": {10104553, 13104553},
+}
+
+// hg38Centromeres are the acen bands from the UCSC cytoBand table.
+var hg38Centromeres = map[string][2]int{
+	"1": {121700000, 125100000}, "2": {91800000, 96000000}, "3": {87800000, 94000000},
+	"4": {48200000, 51800000}, "5": {46100000, 51400000}, "6": {58500000, 62600000},
+	"7": {58100000, 62100000}, "8": {43200000, 47200000}, "9": {42200000, 45500000},
+	"10": {38000000, 41600000}, "11": {51000000, 55800000}, "12": {33200000, 37800000},
+	"13": {16500000, 18900000}, "14": {16100000, 18200000}, "15": {17500000, 20500000},
+	"16": {35300000, 38400000}, "17": {22700000, 27400000}, "18": {15400000, 21500000},
+	"19": {24200000, 28100000}, "20": {25700000, 30400000}, "21": {10900000, 13000000},
+	"22": {13700000, 17400000}, "X": {58100000, 61000000}, "Y": {10300000, 10600000},
+}
+
+// getCentromeres returns the centromeres keyed by chromosome name without any "chr" prefix.
+// If path is empty, the genome build is guessed from the length of chromosome 1 and nil
+// is returned if it is not hg19/GRCh37 or hg38/GRCh38. If there are multiple intervals for a
+// chromosome in path, their extent is used.
+func getCentromeres(path string, refs []*sam.Reference) map[string][2]int {
+	if path != "" {
+		cens := make(map[string][2]int)
+		for chrom, regions := range readRegions(path) {
+			cen := regions[0]
+			for _, r := range regions[1:] {
+				if r[0] < cen[0] {
+					cen[0] = r[0]
+				}
+				if r[1] > cen[1] {
+					cen[1] = r[1]
+				}
+			}
+			cens[chrom] = cen
+		}
+		return cens
+	}
+	switch detectBuild(refs) {
+	case "hg19":
+		log.Println("indexcov: using hg19 centromeres for arm-level copy-number")
+		return hg19Centromeres
+	case "hg38":
+		log.Println("indexcov: using hg38 centromeres for arm-level copy-number")
+		return hg38Centromeres
+	}
+	return nil
+}
+
+// mosaicDelta is the minimum distance of a copy-number estimate from the expected
+// ploidy for it to be reported. Estimates that are not within mosaicDelta of an integer
+// are reported as possible mosaics.
+const mosaicDelta = 0.2
+
+// armCNs holds the per-sample copy-number estimate for each chromosome arm.
+type armCNs struct {
+	arms []string
+	// cns is parallel to arms and each entry has a value per sample.
+	cns [][]float64
+}
+
+// add estimates copy-number for the p and q arms of the chromosome given by cen or for the
+// entire chromosome if cen is nil. Arms with no data in any sample (e.g. acrocentric p arms)
+// are skipped. pos holds the bins of the depths with --targets.
+func (a *armCNs) add(chrom string, depths [][]float32, cen *[2]int, pos []int) {
+	if cen == nil {
+		a.addArm(chrom, depths)
+		return
+	}
+	ps, qs := searchBins(pos, cen[0]/cli.BinSize), searchBins(pos, (cen[1]+cli.BinSize-1)/cli.BinSize)
+	p := make([][]float32, len(depths))
+	q := make([][]float32, len(depths))
+	for k, d := range depths {
+		p[k] = d[:imin(ps, len(d))]
+		q[k] = d[imin(qs, len(d)):]
+	}
+	a.addArm(chrom+"p", p)
+	a.addArm(chrom+"q", q)
+}
+
+func (a *armCNs) addArm(name string, depths [][]float32) {
+	cns := GetCN(depths)
+	for _, c := range cns {
+		if c > 0 {
+			a.arms = append(a.arms, name)
+			a.cns = append(a.cns, cns)
+			return
+		}
+	}
+}
+
+// flags returns the arms of sample i that are likely aneuploid and those that are
+// possibly mosaic.
+func (a *armCNs) flags(i int) (aneuploid []string, mosaic []string) {
+	for j, arm := range a.arms {
+		cn := a.cns[j][i]
+		if cn < 0 || math.Abs(cn-float64(Ploidy)) < mosaicDelta {
+			continue
+		}
+		if math.Abs(cn-math.Floor(cn+0.5)) < mosaicDelta {
+			aneuploid = append(aneuploid, fmt.Sprintf("%s:%.2f", arm, cn))
+		} else {
+			mosaic = append(mosaic, fmt.Sprintf("%s:%.2f", arm, cn))
+		}
+	}
+	return aneuploid, mosaic
+}
+
+// write a matrix of samples by arms with the estimated copy-number.
+func (a *armCNs) write(path string, samples []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#sample\t%s\taneuploid\tpossible_mosaic\n", strings.Join(a.arms, "\t"))
+	vals := make([]string, len(a.arms))
+	for i, s := range samples {
+		for j := range a.arms {
+			if a.cns[j][i] < 0 {
+				vals[j] = "NA"
+			} else {
+				vals[j] = fmt.Sprintf("%.2f", a.cns[j][i])
+			}
+		}
+		aneuploid, mosaic := a.flags(i)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s, strings.Join(vals, "\t"), orNA(aneuploid), orNA(mosaic))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func orNA(s []string) string {
+	if len(s) == 0 {
+		return "NA"
+	}
+	return strings.Join(s, ",")
+}
+
+// armGrid makes armCNs meet the plotter.GridXYZ interface.
+type armGrid struct{ *armCNs }
+
+func (g armGrid) Dims() (c, r int) { return len(g.arms), len(g.cns[0]) }
+func (g armGrid) Z(c, r int) float64 {
+	if v := g.cns[c][r]; v >= 0 {
+		return v
+	}
+	return math.NaN()
+}
+func (g armGrid) X(c int) float64 { return float64(c) }
+func (g armGrid) Y(r int) float64 { return float64(r) }
+
+// plot a heatmap of samples by arms colored by copy-number.
+func (a *armCNs) plot(path string, samples []string) error {
+	if len(a.arms) == 0 || len(samples) == 0 {
+		return nil
+	}
+	cmap := moreland.SmoothBlueRed()
+	cmap.SetMin(0)
+	cmap.SetMax(2 * float64(Ploidy))
+	h := plotter.NewHeatMap(armGrid{a}, cmap.Palette(64))
+	h.Min, h.Max = 0, 2*float64(Ploidy)
+	h.Underflow = h.Palette.Colors()[0]
+	h.Overflow = h.Palette.Colors()[63]
+	h.NaN = color.Gray{Y: 220}
+
+	p := plot.New()
+	p.Add(h)
+	p.X.Label.Text = "chromosome arm"
+	p.Y.Label.Text = "sample"
+	xt := make([]plot.Tick, len(a.arms))
+	for i, arm := range a.arms {
+		xt[i] = plot.Tick{Value: float64(i), Label: arm}
+	}
+	p.X.Tick.Marker = plot.ConstantTicks(xt)
+	p.X.Tick.Label.Rotation = math.Pi / 2
+	p.X.Tick.Label.XAlign = draw.XRight
+	p.X.Tick.Label.YAlign = draw.YCenter
+	var yt []plot.Tick
+	if len(samples) <= 50 {
+		yt = make([]plot.Tick, len(samples))
+		for i, s := range samples {
+			yt[i] = plot.Tick{Value: float64(i), Label: s}
+		}
+	}
+	p.Y.Tick.Marker = plot.ConstantTicks(yt)
+
+	hInches := 4 + math.Min(float64(len(samples))*0.12, 8)
+	return savePlot(p, path, vg.Length(2+0.18*float64(len(a.arms)))*vg.Inch, vg.Length(hInches)*vg.Inch, true)
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
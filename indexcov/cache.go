@@ -0,0 +1,109 @@
+package indexcov
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// cacheVersion is incremented when the contents of a cache entry change.
+const cacheVersion = 2
+
+// cacheEntry holds everything that indexcov calculates from a single index so that
+// unchanged indexes do not need to be re-read when samples are added to a cohort.
+type cacheEntry struct {
+	Version int
+	// Path, Index, Size and ModTime are the key. Path is the file sent by the user and
+	// Index is the index file that was read.
+	Path    string
+	Index   string
+	Size    int64
+	ModTime int64
+
+	Name              string
+	MedianSizePerTile float64
+	Mapped            uint64
+	Unmapped          uint64
+	Sizes             [][]int64
+	Names             []string
+	Platform          string
+}
+
+// cachePath returns the path in dir of the cache entry for the user-specified path.
+func cachePath(dir string, path string) string {
+	if !isURL(path) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return filepath.Join(dir, fmt.Sprintf("%016x.idxcov.gz", h.Sum64()))
+}
+
+// readCached returns the Index and sample name from the cache or nil if the index
+// is not in the cache or has changed since it was cached.
+func readCached(dir string, path string, index string) (*Index, string) {
+	size, mod, err := statPath(index)
+	if err != nil {
+		return nil, ""
+	}
+	f, err := os.Open(cachePath(dir, path))
+	if err != nil {
+		return nil, ""
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		log.Printf("indexcov: ignoring bad cache entry for %s: %s", path, err)
+		return nil, ""
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(gz).Decode(&e); err != nil {
+		log.Printf("indexcov: ignoring bad cache entry for %s: %s", path, err)
+		return nil, ""
+	}
+	if e.Version != cacheVersion || e.Path != path || e.Index != index || e.Size != size || e.ModTime != mod {
+		return nil, ""
+	}
+	return &Index{path: path, sizes: e.Sizes, medianSizePerTile: e.MedianSizePerTile,
+		mapped: e.Mapped, unmapped: e.Unmapped, names: e.Names, hdrPlatform: e.Platform}, e.Name
+}
+
+// writeCached saves an initialized Index to the cache. Errors are logged but are
+// not fatal since the cache is only an optimization.
+func writeCached(dir string, path string, index string, idx *Index, name string) {
+	size, mod, err := statPath(index)
+	if err != nil {
+		log.Printf("indexcov: not caching %s: %s", path, err)
+		return
+	}
+	e := cacheEntry{Version: cacheVersion, Path: path, Index: index, Size: size, ModTime: mod,
+		Name: name, MedianSizePerTile: idx.medianSizePerTile, Mapped: idx.mapped, Unmapped: idx.unmapped, Sizes: idx.sizes, Names: idx.names, Platform: idx.hdrPlatform}
+
+	// write to a temporary file and rename so that concurrent runs never see a partial entry.
+	f, err := os.CreateTemp(dir, ".idxcov-*")
+	if err != nil {
+		log.Printf("indexcov: not caching %s: %s", path, err)
+		return
+	}
+	gz := gzip.NewWriter(f)
+	err = gob.NewEncoder(gz).Encode(e)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cachePath(dir, path))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("indexcov: not caching %s: %s", path, err)
+	}
+}
@@ -38,6 +38,21 @@ func (s Slice) Span() int64 {
 
 type Index struct {
 	Slices [][]Slice
+	// Unmapped is the total size in bytes of the slices of unmapped reads (seqID -1).
+	Unmapped int64
+	// MultiRef is the total size in bytes of the slices with reads from multiple references (seqID -2).
+	MultiRef int64
+}
+
+// Mapped returns the total size in bytes of the slices of mapped reads including multi-reference slices.
+func (idx *Index) Mapped() int64 {
+	n := idx.MultiRef
+	for _, slices := range idx.Slices {
+		for _, sl := range slices {
+			n += int64(sl.sliceLen)
+		}
+	}
+	return n
 }
 
 const TileWidth = 16384
@@ -142,12 +157,8 @@ func ReadIndex(r io.Reader) (*Index, error) {
 		if err != nil {
 			return nil, fmt.Errorf("crai: unable to parse seqID (%s) at line %d", parts[0], iline)
 		}
-		if si == -1 {
-			// TODO: handle unmapped.
-			continue
-		}
-		for i := len(idx.Slices); i <= si; i++ {
-			idx.Slices = append(idx.Slices, make([]Slice, 0, 16))
+		if si < -2 {
+			return nil, fmt.Errorf("crai: invalid seqID (%d) at line %d", si, iline)
 		}
 
 		sl := Slice{}
@@ -160,7 +171,7 @@ func ReadIndex(r io.Reader) (*Index, error) {
 		if alnSpan, err := strconv.Atoi(parts[2]); err != nil {
 			return nil, fmt.Errorf("crai: unable to parse alignment span (%s) at line %d", parts[2], iline)
 		} else {
-			if alnSpan < 0 {
+			if alnSpan < 0 && si >= 0 {
 				log.Printf("crai: negative alnSpan in line %d: %s. breaking early.", iline, line)
 				break
 			}
@@ -184,6 +195,20 @@ func ReadIndex(r io.Reader) (*Index, error) {
 		} else {
 			sl.sliceLen = int32(sliceLen)
 		}
+		// unmapped and multi-reference slices have no position so only their size is kept.
+		if si == -1 {
+			idx.Unmapped += int64(sl.sliceLen)
+			iline++
+			continue
+		}
+		if si == -2 {
+			idx.MultiRef += int64(sl.sliceLen)
+			iline++
+			continue
+		}
+		for i := len(idx.Slices); i <= si; i++ {
+			idx.Slices = append(idx.Slices, make([]Slice, 0, 16))
+		}
 		idx.Slices[si] = append(idx.Slices[si], sl)
 
 		iline++
@@ -1048,3 +1048,28 @@ func TestSizes(t *testing.T) {
 		fmt.Printf("1\t%d\t%d\t%d\n", i*16384, (i+1)*16384, c)
 	}
 }
+
+func TestUnmappedMultiRef(t *testing.T) {
+	s := strings.NewReader(`0	10	20	30	40	50
+-2	0	0	100	4	70
+1	10	20	200	40	60
+-1	0	0	300	4	1000
+-1	0	0	400	4	500
+`)
+	cr, err := crai.ReadIndex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Slices) != 2 {
+		t.Fatalf("expected 2 chromosomes, got %d", len(cr.Slices))
+	}
+	if cr.Unmapped != 1500 {
+		t.Errorf("expected 1500 unmapped bytes, got %d", cr.Unmapped)
+	}
+	if cr.MultiRef != 70 {
+		t.Errorf("expected 70 multi-reference bytes, got %d", cr.MultiRef)
+	}
+	if cr.Mapped() != 180 {
+		t.Errorf("expected 180 mapped bytes, got %d", cr.Mapped())
+	}
+}
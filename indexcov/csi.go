@@ -0,0 +1,182 @@
+package indexcov
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// readCSI reads an uncompressed CSI stream. CSI indexes use a binning scheme of
+// configurable resolution (min_shift) and depth rather than the fixed 16KB linear
+// index of a BAI. The left offset of each bin at the lowest level gives the same
+// information as the linear index, so those are used and the per-bin byte deltas
+// are re-tiled onto the 16KB grid used everywhere else in indexcov. Unlike
+// biogo/hts/csi, the chunks are not kept.
+func readCSI(r io.Reader) (*linearIndex, error) {
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:3]) != "CSI" {
+		return nil, errors.New("csi: magic number mismatch")
+	}
+	version := magic[3]
+	if version != 0x1 && version != 0x2 {
+		return nil, fmt.Errorf("csi: unknown version: %d", version)
+	}
+	var hdr [3]int32
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] < 0 || hdr[1] < 0 || hdr[2] < 0 {
+		return nil, errors.New("csi: invalid header")
+	}
+	minShift, depth := uint32(hdr[0]), uint32(hdr[1])
+	if minShift+3*depth > 62 {
+		return nil, fmt.Errorf("csi: unsupported min_shift (%d) and depth (%d)", minShift, depth)
+	}
+	// skip the auxilliary data (e.g. a tabix header).
+	if _, err := br.Discard(int(hdr[2])); err != nil {
+		return nil, err
+	}
+
+	// bins at the lowest level are numbered starting at leafStart.
+	// these are uint64 as they overflow a uint32 for depths above 9.
+	leafStart := ((uint64(1) << (3 * depth)) - 1) / 7
+	statsBin := ((uint64(1)<<(3*(depth+1)))-1)/7 + 1
+
+	var nRef int32
+	if err := binary.Read(br, binary.LittleEndian, &nRef); err != nil {
+		return nil, err
+	}
+	idx := &linearIndex{sizes: make([][]int64, nRef)}
+	for i := range idx.sizes {
+		var nBin int32
+		if err := binary.Read(br, binary.LittleEndian, &nBin); err != nil {
+			return nil, fmt.Errorf("csi: failed to read bin count: %v", err)
+		}
+		leaves := make(map[uint32]int64, nBin)
+		var maxLeaf = -1
+		for b := int32(0); b < nBin; b++ {
+			var bin uint32
+			var loff uint64
+			if err := binary.Read(br, binary.LittleEndian, &bin); err != nil {
+				return nil, fmt.Errorf("csi: failed to read bin number: %v", err)
+			}
+			if err := binary.Read(br, binary.LittleEndian, &loff); err != nil {
+				return nil, fmt.Errorf("csi: failed to read left virtual offset: %v", err)
+			}
+			if version == 0x2 {
+				var records uint64
+				if err := binary.Read(br, binary.LittleEndian, &records); err != nil {
+					return nil, fmt.Errorf("csi: failed to read record count: %v", err)
+				}
+			}
+			var nChunk int32
+			if err := binary.Read(br, binary.LittleEndian, &nChunk); err != nil {
+				return nil, fmt.Errorf("csi: failed to read chunk count: %v", err)
+			}
+			if uint64(bin) == statsBin {
+				if nChunk != 2 {
+					return nil, errors.New("csi: malformed dummy bin header")
+				}
+				var stats [4]uint64
+				if err := binary.Read(br, binary.LittleEndian, &stats); err != nil {
+					return nil, fmt.Errorf("csi: failed to read reference stats: %v", err)
+				}
+				idx.mapped += stats[2]
+				idx.unmapped += stats[3]
+				continue
+			}
+			if _, err := br.Discard(16 * int(nChunk)); err != nil {
+				return nil, fmt.Errorf("csi: failed to read chunks: %v", err)
+			}
+			if b := uint64(bin); b >= leafStart && b < statsBin {
+				leaves[uint32(b-leafStart)] = int64(loff)
+				if int(b-leafStart) > maxLeaf {
+					maxLeaf = int(b - leafStart)
+				}
+			}
+		}
+		sizes, err := retile(leafOffsets(leaves, maxLeaf+1), minShift)
+		if err != nil {
+			return nil, err
+		}
+		idx.sizes[i] = sizes
+	}
+	// the optional n_no_coor is not needed.
+	return idx, nil
+}
+
+// leafOffsets converts the sparse leaf bins into a dense slice like the linear index
+// of a BAI. Leaves without a bin (e.g. covered only by reads spanning bin boundaries)
+// are linearly interpolated from their neighbors.
+func leafOffsets(leaves map[uint32]int64, n int) []int64 {
+	offs := make([]int64, n)
+	last := -1
+	for k := 0; k < n; k++ {
+		o, ok := leaves[uint32(k)]
+		if !ok {
+			continue
+		}
+		offs[k] = o
+		if last == -1 {
+			// nothing before the first read.
+			for j := 0; j < k; j++ {
+				offs[j] = o
+			}
+		} else if k-last > 1 {
+			step := float64(o-offs[last]) / float64(k-last)
+			for j := last + 1; j < k; j++ {
+				offs[j] = offs[last] + int64(step*float64(j-last))
+			}
+		}
+		last = k
+	}
+	return offs
+}
+
+// retile takes offsets at a resolution of 1<<minShift and returns the byte deltas
+// for each TileWidth (16KB) tile. An error is returned if the offsets are not sorted.
+func retile(offs []int64, minShift uint32) ([]int64, error) {
+	if len(offs) < 2 {
+		return make([]int64, 0), nil
+	}
+	deltas := make([]int64, len(offs)-1)
+	for k := range deltas {
+		deltas[k] = offs[k+1] - offs[k]
+		if deltas[k] < 0 {
+			return nil, fmt.Errorf("csi: offset of bin %d is before that of bin %d", k+1, k)
+		}
+	}
+	const tileShift = 14
+	switch {
+	case minShift == tileShift:
+		return deltas, nil
+	case minShift < tileShift:
+		// sum several small bins into each tile.
+		f := 1 << (tileShift - minShift)
+		sizes := make([]int64, (len(deltas)+f-1)/f)
+		for k, d := range deltas {
+			sizes[k/f] += d
+		}
+		return sizes, nil
+	default:
+		// split each large bin evenly across its tiles.
+		f := int64(1) << (minShift - tileShift)
+		sizes := make([]int64, 0, int64(len(deltas))*f)
+		for _, d := range deltas {
+			for j := int64(0); j < f; j++ {
+				v := d / f
+				if j < d%f {
+					v++
+				}
+				sizes = append(sizes, v)
+			}
+		}
+		return sizes, nil
+	}
+}
@@ -0,0 +1,164 @@
+package indexcov
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/faidx"
+	"github.com/brentp/goleft/dcnv/debiaser"
+	"github.com/brentp/xopen"
+	"gonum.org/v1/gonum/mat"
+)
+
+// biasWindow is the number of tiles, sorted by the covariate, in the moving median used for correction.
+const biasWindow = 201
+
+// debiasScale is applied before debiaser.GeneralDebiaser.Debias as that divides by a median of at least 1.
+const debiasScale = 1000
+
+// minMappability is the lowest mean mappability for a tile to be used in (and corrected by) the
+// mappability debiasing.
+const minMappability = 0.2
+
+// tileGC returns the GC content of each bin (of --bin-size) in chrom. Tiles without any (non-N) sequence are -1.
+// If chrom is not in the fasta, nil is returned.
+func tileGC(fa *faidx.Faidx, chrom string, length int) []float64 {
+	name := chrom
+	if _, ok := fa.Index[name]; !ok {
+		if name = stripChr(chrom); name == chrom {
+			name = "chr" + chrom
+		}
+		if _, ok := fa.Index[name]; !ok {
+			log.Printf("indexcov: %s not found in fasta. not correcting GC bias", chrom)
+			return nil
+		}
+	}
+	w := cli.BinSize
+	n := (length + w - 1) / w
+	gcs := make([]float64, n)
+	for i := range gcs {
+		end := (i + 1) * w
+		if end > length {
+			end = length
+		}
+		st, err := fa.Stats(name, i*w, end)
+		if err != nil {
+			log.Fatalf("indexcov: error getting GC for %s:%d-%d: %s", chrom, i*w, end, err)
+		}
+		gcs[i] = st.GC
+		if st == (faidx.Stats{}) {
+			gcs[i] = -1
+		}
+	}
+	return gcs
+}
+
+// readMappability reads a bedGraph of mappability scores (0 to 1) and returns the mean score for each
+// bin (of --bin-size), weighted by overlap, keyed by chromosome without any "chr" prefix. Bases that are
+// not covered by an interval are counted as 0.
+func readMappability(path string) map[string][]float64 {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		log.Fatalf("indexcov: error opening %s: %s", path, err)
+	}
+	defer rdr.Close()
+	maps := make(map[string][]float64)
+	w := cli.BinSize
+	br := bufio.NewReader(rdr)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && line[0] != '#' && !strings.HasPrefix(line, "track") && strings.TrimSpace(line) != "" {
+			toks := strings.Split(strings.TrimSpace(line), "\t")
+			if len(toks) < 4 {
+				log.Fatalf("indexcov: expected at least 4 columns in mappability file %s: %s", path, line)
+			}
+			start, e1 := strconv.Atoi(toks[1])
+			end, e2 := strconv.Atoi(toks[2])
+			score, e3 := strconv.ParseFloat(toks[3], 64)
+			if e1 != nil || e2 != nil || e3 != nil {
+				log.Fatalf("indexcov: bad line in %s: %s", path, line)
+			}
+			chrom := stripChr(toks[0])
+			m := maps[chrom]
+			if need := (end + w - 1) / w; need > len(m) {
+				m = append(m, make([]float64, need-len(m))...)
+			}
+			for s := start; s < end; {
+				i := s / w
+				e := (i + 1) * w
+				if e > end {
+					e = end
+				}
+				m[i] += score * float64(e-s) / float64(w)
+				s = e
+			}
+			maps[chrom] = m
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return maps
+}
+
+// debiasDepths removes the dependence of depth on a per-tile covariate (e.g. GC) in each sample.
+// Only tiles with a covariate >= minVal are used and changed. The depth of each tile is divided by
+// the median depth of tiles with a similar covariate and multiplied by the median depth of the
+// sample on this chromosome so that changes in copy-number of the entire chromosome are kept.
+// depths is modified in place.
+func debiasDepths(depths [][]float32, covariate []float64, minVal float64) {
+	var rows []int
+	for i, v := range covariate {
+		if v >= minVal {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < 2*biasWindow || len(depths) == 0 {
+		return
+	}
+	orig := mat.NewDense(len(rows), len(depths), nil)
+	meds := make([]float64, len(depths))
+	tmp := make([]float64, 0, len(rows))
+	for k, d := range depths {
+		tmp = tmp[:0]
+		for r, i := range rows {
+			if i < len(d) {
+				orig.Set(r, k, debiasScale*float64(d[i]))
+				if d[i] > 0 {
+					tmp = append(tmp, float64(d[i]))
+				}
+			}
+		}
+		if len(tmp) > 0 {
+			sort.Float64s(tmp)
+			meds[k] = tmp[len(tmp)/2]
+		}
+	}
+	m := mat.DenseCopyOf(orig)
+
+	db := debiaser.GeneralDebiaser{Window: biasWindow, Vals: make([]float64, len(rows))}
+	for r, i := range rows {
+		db.Vals[r] = covariate[i]
+	}
+	db.Sort(m)
+	db.Debias(m)
+	db.Unsort(m)
+
+	for k, d := range depths {
+		for r, i := range rows {
+			// Debias divides by at least 1 so a value that did not decrease was in a window
+			// without coverage and is left as-is.
+			if i >= len(d) || m.At(r, k) >= orig.At(r, k) {
+				continue
+			}
+			d[i] = float32(m.At(r, k) * meds[k])
+		}
+	}
+}
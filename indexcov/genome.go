@@ -0,0 +1,108 @@
+package indexcov
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/xopen"
+)
+
+// hg19PARs are the pseudo-autosomal regions on the sex chromosomes in hg19/GRCh37.
+var hg19PARs = map[string][][2]int{
+	"X": {{60000, 2699520}, {154931043, 155260560}},
+	"Y": {{10000, 2649520}, {59034049, 59363566}},
+}
+
+// hg38PARs are the pseudo-autosomal regions on the sex chromosomes in hg38/GRCh38.
+var hg38PARs = map[string][][2]int{
+	"X": {{10000, 2781479}, {155701382, 156030895}},
+	"Y": {{10000, 2781479}, {56887902, 57217415}},
+}
+
+func stripChr(chrom string) string {
+	if strings.HasPrefix(chrom, "chr") {
+		return chrom[3:]
+	}
+	return chrom
+}
+
+// detectBuild guesses the human genome build from the length of chromosome 1.
+// It returns "hg19", "hg38" or "" if the build is not known.
+func detectBuild(refs []*sam.Reference) string {
+	for _, ref := range refs {
+		if stripChr(ref.Name()) != "1" {
+			continue
+		}
+		switch ref.Len() {
+		case 249250621:
+			return "hg19"
+		case 248956422:
+			return "hg38"
+		}
+	}
+	return ""
+}
+
+// getPARs returns the pseudo-autosomal regions keyed by chromosome without any "chr" prefix.
+// If path is empty, the regions for hg19 or hg38 are used if the build is detected.
+func getPARs(path string, refs []*sam.Reference) map[string][][2]int {
+	if path != "" {
+		return readRegions(path)
+	}
+	switch detectBuild(refs) {
+	case "hg19":
+		return hg19PARs
+	case "hg38":
+		return hg38PARs
+	}
+	return nil
+}
+
+// readRegions reads the intervals in a BED file keyed by chromosome without any "chr" prefix.
+func readRegions(path string) map[string][][2]int {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		log.Fatalf("indexcov: error opening %s: %s", path, err)
+	}
+	defer rdr.Close()
+	regions := make(map[string][][2]int)
+	br := bufio.NewReader(rdr)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && line[0] != '#' && !strings.HasPrefix(line, "track") && strings.TrimSpace(line) != "" {
+			toks := strings.Split(strings.TrimSpace(line), "\t")
+			if len(toks) < 3 {
+				log.Fatalf("indexcov: expected at least 3 columns in %s: %s", path, line)
+			}
+			start, e1 := strconv.Atoi(toks[1])
+			end, e2 := strconv.Atoi(toks[2])
+			if e1 != nil || e2 != nil {
+				log.Fatalf("indexcov: bad line in %s: %s", path, line)
+			}
+			chrom := stripChr(toks[0])
+			regions[chrom] = append(regions[chrom], [2]int{start, end})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return regions
+}
+
+// inRegions returns true if the bin i (of --bin-size) overlaps any of the regions.
+func inRegions(regions [][2]int, i int) bool {
+	s, e := i*cli.BinSize, (i+1)*cli.BinSize
+	for _, r := range regions {
+		if r[1] > s && r[0] < e {
+			return true
+		}
+	}
+	return false
+}
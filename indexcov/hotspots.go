@@ -0,0 +1,120 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// hotspotHigh and hotspotLow are the scaled depths above and below which a bin is extreme in a sample.
+const hotspotHigh = 2.0
+const hotspotLow = 0.15
+
+// hotspotFraction is the minimum proportion of samples that must be extreme at a bin for it to be a hotspot.
+const hotspotFraction = 0.8
+
+// minHotspotSamples is the minimum number of samples needed to find hotspots.
+const minHotspotSamples = 5
+
+// hotspot is a run of adjacent bins that are extreme in most samples.
+type hotspot struct {
+	typ string
+	// start and end are indexes into the depths (half-open).
+	start, end int
+	// sum is the sum of the median depth of each bin.
+	sum float64
+}
+
+// writeHotspots writes the bins of chrom that are above hotspotHigh or below hotspotLow in most samples as
+// BED with columns of chrom, start, end, type ("high" or "low"), number of bins and mean of the median depths.
+// Adjacent bins of the same type are merged. Bins that are 0 in every sample are gaps in the reference and
+// are not reported. pos holds the bins of the depths with --targets. It returns the number of bins written.
+func writeHotspots(w io.Writer, chrom string, depths [][]float32, pos []int) int {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	var cur *hotspot
+	nBins := 0
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		n := cur.end - cur.start
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%.3f\n", chrom, binStart(pos, cur.start), binStart(pos, cur.end-1)+cli.BinSize,
+			cur.typ, n, cur.sum/float64(n))
+		nBins += n
+		cur = nil
+	}
+	vals := make([]float64, 0, len(depths))
+	for j := 0; j < longest; j++ {
+		vals = vals[:0]
+		high, low, nonZero := 0, 0, false
+		for _, d := range depths {
+			if j >= len(d) {
+				continue
+			}
+			v := d[j]
+			vals = append(vals, float64(v))
+			if v > hotspotHigh {
+				high++
+			} else if v < hotspotLow {
+				low++
+			}
+			if v != 0 {
+				nonZero = true
+			}
+		}
+		min := hotspotFraction * float64(len(vals))
+		typ := ""
+		if len(vals) > 0 && float64(high) >= min {
+			typ = "high"
+		} else if len(vals) > 0 && nonZero && float64(low) >= min {
+			typ = "low"
+		}
+		if cur != nil && (typ != cur.typ || binIndex(pos, j) != binIndex(pos, cur.end-1)+1) {
+			flush()
+		}
+		if typ == "" {
+			continue
+		}
+		if cur == nil {
+			cur = &hotspot{typ: typ, start: j}
+		}
+		sort.Float64s(vals)
+		cur.sum += vals[len(vals)/2]
+		cur.end = j + 1
+	}
+	flush()
+	return nBins
+}
+
+// maskedBins returns whether each of the first n values of the depths for the reference with the given ID is in
+// a bin of --mask. pos holds the bins of the depths with --targets. It is nil if there is no mask.
+func maskedBins(id int, pos []int, n int) []bool {
+	if cli.mask == nil {
+		return nil
+	}
+	masked := make([]bool, n)
+	for i := range masked {
+		masked[i] = cli.mask.contains(id, binIndex(pos, i))
+	}
+	return masked
+}
+
+// hotspotsThenNormalize writes the hotspots of chrom to w if it is not nil and then normalizes the depths
+// across samples if normalize is true. The hotspots are found first as the normalization brings bins that
+// are inflated in most samples back to about 1. It returns the number of hotspot bins.
+func hotspotsThenNormalize(w *bufio.Writer, chrom string, depths [][]float32, pos []int, normalize bool) int {
+	n := 0
+	if w != nil {
+		n = writeHotspots(w, chrom, depths, pos)
+	}
+	if normalize {
+		normalizeAcrossSamples(depths)
+	}
+	return n
+}
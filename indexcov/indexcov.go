@@ -27,6 +27,7 @@ import (
 	"github.com/biogo/hts/bam"
 	"github.com/biogo/hts/bgzf"
 	"github.com/biogo/hts/sam"
+	"github.com/brentp/faidx"
 	chartjs "github.com/brentp/go-chartjs"
 	"github.com/brentp/go-chartjs/types"
 	"github.com/brentp/goleft"
@@ -45,25 +46,72 @@ var cli = &struct {
 	Chrom          string         `arg:"-c,help:optional chromosome to extract depth. default is entire genome."`
 	Fai            string         `arg:"-f,help:fasta index file. Required when crais are used."`
 	ExtraNormalize bool           `arg:"-n,help:normalize across samples and do local smoothign within sample. this is recommended for CRAI"`
-	Bam            []string       `arg:"positional,required,help:bam(s) or crais for which to estimate coverage"`
+	Centromeres    string         `arg:"help:BED file of centromeres used to estimate copy-number for each chromosome arm. hg19 and hg38 are detected automatically."`
+	CacheDir       string         `arg:"--cache-dir,help:directory to cache values calculated from each index. unchanged indexes are not re-read on later runs."`
+	QCZ            float64        `arg:"--qc-z,help:samples with a robust z-score for any of the bins or slope metrics beyond this value fail QC."`
+	QCDistance     float64        `arg:"--qc-distance,help:samples with a robust Mahalanobis distance in PC space above this value fail QC."`
+	SexNormalize   bool           `arg:"help:scale depth on sex chromosomes by the inferred copy-number so haploid regions are 1. raw values are written to a separate file."`
+	PAR            string         `arg:"help:BED file of pseudo-autosomal regions that are not scaled by --sexnormalize. hg19 and hg38 are detected automatically."`
+	NoPlatforms    bool           `arg:"--no-platform-normalize,help:do not scale the samples from each platform (short-read or long-read) at every bin to match the largest platform."`
+	Fasta          string         `arg:"--fasta,help:reference fasta used to correct GC bias in each bin."`
+	Mappability    string         `arg:"--mappability,help:bedGraph of mappability scores (0 to 1) used to correct mappability bias. bigWigs must be converted with bigWigToBedGraph."`
+	PCAModel       string         `arg:"--pca-model,help:project samples onto the PCs in this model (from --save-pca-model) and plot them over the reference samples."`
+	SavePCAModel   string         `arg:"--save-pca-model,help:write the PCA loadings and centering to this path for use with --pca-model."`
+	SingleHTML     bool           `arg:"--single-html,help:also write a self-contained HTML report with all plots and the .ped inlined for viewing offline."`
+	Parallel       int            `arg:"help:number of indexes to read (or fetch from a URL) at once."`
+	Parquet        bool           `arg:"--parquet,help:also write the depths and ROCs as .parquet files for use with pandas or DuckDB."`
+	Ped            string         `arg:"--ped,help:PED file with the declared sex and family of each sample. discordant samples are reported."`
+	AllPairs       bool           `arg:"--all-pairs,help:write the correlation of the coverage profiles of every pair of samples to the .relatedness.tsv instead of only the likely duplicates."`
+	BinSize        int            `arg:"--bin-size,help:size of the bins used for all output. must be a multiple of 16384 (the resolution of the index)."`
+	MaxMemory      string         `arg:"--max-memory,help:approximate limit on memory use (e.g. 16G). depths are kept on disk and fewer tiles are used for the PCA to stay under this."`
+	Targets        string         `arg:"--targets,help:BED file of capture regions (e.g. for exomes). only bins that overlap these are used and the off-target rate is reported."`
+	Mask           string         `arg:"--mask,help:BED file of bins (e.g. the .hotspots.bed from an earlier run) to exclude from normalization and the PCA and bins counts."`
+	Pairs          string         `arg:"--pairs,help:file with tumor and normal sample names in the first 2 columns. log2 ratios of each pair are segmented and plotted."`
+	PairMinTiles   int            `arg:"--pair-min-tiles,help:minimum number of bins for a segment of the log2 ratios of a pair from --pairs."`
+	Format         string         `arg:"--format,help:also save every plot (depth PCA bins mapped sex ROC arms and pairs) as png svg or pdf for use in reports."`
+	Region         string         `arg:"--region,help:region (chr:start-end) to zoom in on. the depth of each sample in the bins of the region is written and plotted."`
+	Regions        string         `arg:"--regions,help:BED file of regions (e.g. a gene panel) to zoom in on like --region. names are taken from the 4th column."`
+	Genes          string         `arg:"--genes,help:BED (with names in the 4th column) or GTF file of genes to draw in the --region and --regions plots."`
+	CNVMinTiles    int            `arg:"help:minimum number of bins for a segment to be reported as a CNV. Set to 0 to skip segmentation."`
+	Bam            []string       `arg:"positional,required,help:bam(s) or bais/csis/crais/tbis for which to estimate coverage"`
 	sex            []string       `arg:"-"`
 	exclude        *regexp.Regexp `arg:"-"`
-}{Sex: "X,Y", ExcludePatt: `^chrEBV$|^NC|_random$|Un_|^HLA\-|_alt$|hap\d$`}
+	targets        targetBins     `arg:"-"`
+	mask           targetBins     `arg:"-"`
+	regions        []*zoomRegion  `arg:"-"`
+	// platforms has the sequencing platform of each sample and platformGroups the samples that are
+	// normalized together when there is more than one platform.
+	platforms      []string `arg:"-"`
+	platformGroups [][]int  `arg:"-"`
+	// pcaStride is the interval between tiles used for the PCA.
+	pcaStride int `arg:"-"`
+	// genomePoints is the number of points for each sample in the genome-wide plots.
+	genomePoints int `arg:"-"`
+}{Sex: "X,Y", Parallel: 8, CNVMinTiles: 10, PairMinTiles: 10, BinSize: TileWidth, QCZ: 5, QCDistance: 4.5, ExcludePatt: `^chrEBV$|^NC|_random$|Un_|^HLA\-|_alt$|hap\d$`}
 
 // MaxCN is the maximum normalized value.
 var MaxCN = float32(8)
 
-// Index wraps a bam.Index to cache calculated values.
+// Index wraps a bai, csi, tbi or crai index to cache calculated values.
 type Index struct {
-	*bam.Index
+	lin  *linearIndex
 	crai *crai.Index
 	path string
 
 	//mu                *sync.RWMutex
 	medianSizePerTile float64
 	sizes             [][]int64
-	mapped            uint64
-	unmapped          uint64
+	// names is set for tabix indexes until the sizes are matched to the references.
+	names    []string
+	mapped   uint64
+	unmapped uint64
+	// offTarget is the proportion of the size outside of the --targets bins.
+	offTarget float64
+	// hdrPlatform is the platform in the header when the sample name was read from a bam.
+	hdrPlatform string
+	// platform is the class of the sample from the header or the bytes per read.
+	platform     string
+	bytesPerRead float64
 }
 
 func (i *Index) Path() string {
@@ -75,27 +123,44 @@ func (i *Index) Sizes() [][]int64 {
 	return i.sizes
 }
 
-func vOffset(o bgzf.Offset) int64 {
-	return o.File<<16 | int64(o.Block)
-}
-
 // init sets the medianSizePerTile
 func (x *Index) init() {
-	if x.Index != nil {
-		x.sizes, x.mapped, x.unmapped = getSizes(x.Index)
-		x.Index = nil
+	if x.lin != nil {
+		x.sizes, x.mapped, x.unmapped, x.names = x.lin.sizes, x.lin.mapped, x.lin.unmapped, x.lin.names
+		x.lin = nil
 	} else if x.crai != nil {
 		x.sizes = x.crai.Sizes()
 		if x.sizes == nil {
 			log.Fatal("bad index:", x.path)
 		}
+		// crais have only the size of each slice so these are bytes rather than reads.
+		x.mapped, x.unmapped = uint64(x.crai.Mapped()), uint64(x.crai.Unmapped)
 		x.crai = nil
 	}
+	x.setMedian(nil, nil)
+}
 
+// setMedian sets the medianSizePerTile from the sizes. If t is not nil, only the sizes
+// in the target bins are used. Bins in mask are not used.
+func (x *Index) setMedian(t targetBins, mask targetBins) {
 	// sizes is used to get the median.
-	sizes := make([]int64, 0, 16384)
-	for k := 0; k < len(x.sizes); k++ {
-		sizes = append(sizes, x.sizes[k]...)
+	var sizes []int64
+	if t != nil {
+		sizes = t.sizes(x.sizes, mask)
+	} else if mask != nil {
+		sizes = make([]int64, 0, 16384)
+		for k := 0; k < len(x.sizes); k++ {
+			for i, s := range x.sizes[k] {
+				if !mask.contains(k, i) {
+					sizes = append(sizes, s)
+				}
+			}
+		}
+	} else {
+		sizes = make([]int64, 0, 16384)
+		for k := 0; k < len(x.sizes); k++ {
+			sizes = append(sizes, x.sizes[k]...)
+		}
 	}
 	if len(sizes) < 1 {
 		log.Fatalf("indexcov: no usable chromsomes in bam: %s", x.path)
@@ -124,6 +189,22 @@ func (x *Index) init() {
 	x.medianSizePerTile = float64(sizes[idx])
 }
 
+// aggregate sums every n tiles into a single bin and updates the median so that depths are for
+// bins of n tiles. The last bin of each chromosome may have fewer tiles.
+func (x *Index) aggregate(n int) {
+	if n <= 1 {
+		return
+	}
+	for k, sizes := range x.sizes {
+		bins := make([]int64, (len(sizes)+n-1)/n)
+		for i, s := range sizes {
+			bins[i/n] += s
+		}
+		x.sizes[k] = bins
+	}
+	x.setMedian(nil, nil)
+}
+
 // NormalizedDepth returns a list of numbers for the normalized depth of the given region.
 // Values are scaled to have a mean of 1. If end is 0, the full chromosome is returned.
 func (x *Index) NormalizedDepth(refID int) []float32 {
@@ -211,38 +292,46 @@ func getRef(b *bam.Reader, chrom string) *sam.Reference {
 }
 
 func GetShortName(b string, isCrai bool) (string, error) {
+	nm, _, err := shortName(b, isCrai)
+	return nm, err
+}
+
+// shortName is GetShortName that also returns the header of the bam. The header is nil for an index.
+func shortName(b string, isCrai bool) (string, *sam.Header, error) {
 	// TODO: replace this with samplename.Names()
 
+	var hdr *sam.Header
 	if !isCrai {
-		fh, err := os.Open(b)
+		fh, err := openPath(b)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 		defer fh.Close()
 		br, err := bam.NewReader(fh, 1)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 		defer br.Close()
+		hdr = br.Header()
 		m := make(map[string]bool)
-		for _, rg := range br.Header().RGs() {
+		for _, rg := range hdr.RGs() {
 			m[rg.Get(sam.Tag([2]byte{'S', 'M'}))] = true
 		}
 		if len(m) > 1 {
-			return "", fmt.Errorf("bam reagroup: more than one RG for %s", b)
+			return "", nil, fmt.Errorf("bam reagroup: more than one RG for %s", b)
 		}
 		for sm := range m {
-			return sm, nil
+			return sm, hdr, nil
 		}
 	}
 	vs := strings.Split(b, "/")
 	v := vs[len(vs)-1]
 	vs = strings.Split(v, ".")
 	if len(vs) <= 2 {
-		return vs[0], nil
+		return vs[0], hdr, nil
 	}
 	v = strings.Join(vs[0:len(vs)-1], "-")
-	return v, nil
+	return v, hdr, nil
 }
 
 func getWriter(base string) (*bgzf.Writer, error) {
@@ -276,7 +365,7 @@ func getDirectory(path string) (bool, error) {
 // ReadFai returns a slit of references from the fai path.
 // If chrom is "" all chromosomes are returned.
 func ReadFai(path string, chrom string) []*sam.Reference {
-	f, err := os.Open(path)
+	f, err := openPath(path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error opening fai: %s. Is is present?\n", path)
 		panic(err)
@@ -318,7 +407,7 @@ func ReadFai(path string, chrom string) []*sam.Reference {
 }
 
 func RefsFromBam(path string, chrom string) []*sam.Reference {
-	rdr, err := os.Open(path)
+	rdr, err := openPath(path)
 	if err != nil {
 		log.Println("ERROR: since no .fai was specified, expected input to be a list of bams")
 		log.Printf("ERROR: got, e.g. %s", path)
@@ -350,6 +439,18 @@ func getReferences() []*sam.Reference {
 		return ReadFai(cli.Fai, cli.Chrom)
 	}
 
+	if cli.Fasta != "" && existsPath(cli.Fasta+".fai") {
+		return ReadFai(cli.Fasta+".fai", cli.Chrom)
+	}
+
+	if p := findIndex(cli.Bam[0]); strings.HasSuffix(p, ".tbi") {
+		return RefsFromTabix(p, cli.Chrom)
+	}
+
+	if strings.HasSuffix(cli.Bam[0], ".bam.csi") && existsPath(cli.Bam[0][:len(cli.Bam[0])-4]) {
+		return RefsFromBam(cli.Bam[0][:len(cli.Bam[0])-4], cli.Chrom)
+	}
+
 	if strings.HasSuffix(cli.Bam[0], ".crai") {
 		path := cli.Bam[0][:len(cli.Bam[0])-5]
 		if xopen.Exists(cli.Bam[0][:len(cli.Bam[0])-5] + ".cram") {
@@ -376,6 +477,18 @@ func getReferences() []*sam.Reference {
 func expandGlobs(paths []string) []string {
 	result := make([]string, 0, len(paths))
 	for _, p := range paths {
+		if strings.HasPrefix(p, "s3://") && strings.ContainsAny(p, "*?[") {
+			matches, err := globS3(p)
+			if err != nil {
+				log.Fatal("indexcov: error listing:" + p + "\n" + err.Error())
+			}
+			result = append(result, matches...)
+			continue
+		}
+		if isURL(p) {
+			result = append(result, p)
+			continue
+		}
 		matches, err := filepath.Glob(p)
 		if err != nil {
 			log.Fatal("indexcov: error with file path:" + p + "\n" + err.Error())
@@ -402,25 +515,92 @@ func Main() {
 	if cli.ExcludePatt != "" {
 		cli.exclude = regexp.MustCompile(cli.ExcludePatt)
 	}
+	if cli.BinSize < TileWidth || cli.BinSize%TileWidth != 0 {
+		p.Fail(fmt.Sprintf("indexcov: --bin-size must be a multiple of %d", TileWidth))
+	}
+	if cli.Pairs != "" && cli.PairMinTiles < 1 {
+		p.Fail("indexcov: --pair-min-tiles must be at least 1")
+	}
+	if cli.Format != "" && !staticFormats[cli.Format] {
+		p.Fail(fmt.Sprintf("indexcov: --format must be png svg or pdf. got: %s", cli.Format))
+	}
+	// INDEXCOV_FMT is the old way to get vector plots.
+	if f := os.Getenv("INDEXCOV_FMT"); f != "" && cli.Format == "" {
+		cli.Format = "eps"
+		if f == "svg" {
+			cli.Format = "svg"
+		}
+	}
 
 	if exists, err := getDirectory(cli.Directory); err != nil || !exists {
 		log.Fatalf("indexcov: error creating specified directory: %s, %s", cli.Directory, err)
 	}
 
+	if cli.CacheDir != "" {
+		if exists, err := getDirectory(cli.CacheDir); err != nil || !exists {
+			log.Fatalf("indexcov: error creating cache directory: %s, %s", cli.CacheDir, err)
+		}
+	}
+
 	// the lengths and names of references from bams or fasta
 	refs := getReferences()
 
 	cli.Bam = expandGlobs(cli.Bam)
+	maxMem, err := parseMemory(cli.MaxMemory)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	cli.pcaStride = pcaStride(refs, len(cli.Bam), maxMem)
+	cli.genomePoints = genomePoints(len(cli.Bam), maxMem)
+	if cli.Targets != "" {
+		cli.targets = readTargets(cli.Targets, refs)
+	}
+	if cli.Mask != "" {
+		var n int
+		cli.mask, n = readBins(cli.Mask, refs)
+		log.Printf("indexcov: masking %d bins that overlap regions in %s", n, cli.Mask)
+	}
+	if cli.Region != "" || cli.Regions != "" {
+		if cli.regions, err = readZoomRegions(cli.Region, cli.Regions, refs); err != nil {
+			p.Fail(err.Error())
+		}
+		log.Printf("indexcov: zooming in on %d region(s)", len(cli.regions))
+	} else if cli.Genes != "" {
+		p.Fail("indexcov: --genes requires --region or --regions")
+	}
 
 	names := make([]string, len(cli.Bam))
 	idxs := make([]*Index, len(cli.Bam))
-	ch := make(chan rdi, 8)
+	if cli.Parallel < 1 {
+		cli.Parallel = 1
+	}
+	// the depths are written to disk as each index is read and then read back by chromosome in run
+	// so only one chromosome for all samples is in memory at once.
+	store, err := newTileStore(cli.Directory, refs, len(cli.Bam))
+	if err != nil {
+		log.Fatalf("indexcov: error creating temporary files in %s: %s", cli.Directory, err)
+	}
+	defer store.close()
+	ch := make(chan rdi, cli.Parallel)
 	wg := &sync.WaitGroup{}
-	wg.Add(8)
-	for k := 0; k < 8; k++ {
+	wg.Add(cli.Parallel)
+	for k := 0; k < cli.Parallel; k++ {
 		go func() {
 			for r := range ch {
 				idx, name, i := readIndex(r)
+				idx.bytesPerRead = idx.averageReadBytes()
+				idx.platform = samplePlatform(idx.hdrPlatform, idx.bytesPerRead)
+				idx.alignRefs(refs)
+				idx.aggregate(cli.BinSize / TileWidth)
+				if cli.targets != nil {
+					idx.offTarget = cli.targets.offTarget(idx.sizes)
+				}
+				if cli.targets != nil || cli.mask != nil {
+					idx.setMedian(cli.targets, cli.mask)
+				}
+				store.add(i, idx)
+				// only the per-sample values are kept.
+				idx.sizes = nil
 				names[i] = name
 				idxs[i] = idx
 			}
@@ -432,14 +612,42 @@ func Main() {
 	}
 	close(ch)
 	wg.Wait()
+	if cli.Parquet {
+		if d := firstDuplicate(names); d != "" {
+			log.Fatalf("indexcov: sample %s is found more than once. --parquet requires unique sample names", d)
+		}
+	}
+	cli.platforms = make([]string, len(idxs))
+	bytesPerRead := make([]float64, len(idxs))
+	for i, idx := range idxs {
+		cli.platforms[i], bytesPerRead[i] = idx.platform, idx.bytesPerRead
+	}
+	cli.platformGroups = platformGroups(cli.platforms)
+	if cli.platformGroups != nil && cli.NoPlatforms {
+		log.Printf("WARNING: indexcov: samples are from %d platforms with different bytes per read so bin sizes are not comparable across them without platform normalization", len(cli.platformGroups))
+		cli.platformGroups = nil
+	}
+	for _, g := range cli.platformGroups {
+		log.Printf("indexcov: %d samples from platform %s are normalized together", len(g), cli.platforms[g[0]])
+	}
 
-	sexes, counts, pca8, chromNames, slopes := run(refs, idxs, names, getBase(cli.Directory), cli.ExtraNormalize)
+	if cli.SingleHTML {
+		report = newSingleReport()
+	}
+	sexes, counts, pca8, layout, chromNames, slopes, arms, aucs, profiles, pairs := run(refs, idxs, store, names, getBase(cli.Directory), cli.ExtraNormalize)
 	mapped := make([]uint64, len(names))
 	unmapped := make([]uint64, len(names))
+	var offTarget []float64
+	if cli.targets != nil {
+		offTarget = make([]float64, len(names))
+	}
 	anygt := false
 	for i, ix := range idxs {
 		mapped[i] = ix.mapped
 		unmapped[i] = ix.unmapped
+		if offTarget != nil {
+			offTarget[i] = ix.offTarget
+		}
 		if ix.mapped > 0 || ix.unmapped > 0 {
 			anygt = true
 		}
@@ -450,7 +658,7 @@ func Main() {
 	}
 
 	chartjs.XFloatFormat = "%.2f"
-	if indexPath := writeIndex(sexes, counts, names, cli.Directory, pca8, slopes, chromNames, mapped, unmapped); indexPath != "" {
+	if indexPath := writeIndex(sexes, counts, names, cli.Directory, pca8, layout, slopes, chromNames, mapped, unmapped, offTarget, bytesPerRead, arms, aucs, profiles, pairs); indexPath != "" {
 		fmt.Fprintf(os.Stderr, "indexcov finished: see %s for overview of output\n", indexPath)
 	}
 }
@@ -460,7 +668,7 @@ type rdi struct {
 	i       int
 }
 
-// ReadIndex returns an Index pointer from the specified bam or crai path.
+// ReadIndex returns an Index pointer from the specified bam, bai, csi or crai path.
 func ReadIndex(path string) *Index {
 	i, _, _ := readIndex(rdi{path, 0})
 	return i
@@ -470,60 +678,86 @@ func ReadIndex(path string) *Index {
 // `i` is used in the return when parallelized to keep same order.
 func readIndex(r rdi) (*Index, string, int) {
 	b := r.bamPath
+	if strings.HasSuffix(b, ".cram") {
+		log.Printf("WARNING: when using CRAM files, send the crai indexes to indexcov, not the alignment files")
+	}
+	path := findIndex(b)
 
-	if strings.HasSuffix(b, ".crai") {
-		f, err := os.Open(b)
-		if err != nil {
-			panic(err)
+	if cli.CacheDir != "" {
+		if idx, nm := readCached(cli.CacheDir, b, path); idx != nil {
+			return idx, nm, r.i
 		}
+	}
+
+	f, err := openPath(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	idx := &Index{path: b}
+	if strings.HasSuffix(path, ".crai") || strings.HasSuffix(path, ".csi") || strings.HasSuffix(path, ".tbi") {
 		gz, err := gzip.NewReader(f)
 		if err != nil {
-			log.Printf("error from index: %s", b)
+			log.Printf("error from index: %s", path)
 			panic(err)
 		}
-		cr, err := crai.ReadIndex(gz)
-		if err != nil {
-			log.Printf("error from index: %s", b)
-			panic(err)
+		switch {
+		case strings.HasSuffix(path, ".crai"):
+			idx.crai, err = crai.ReadIndex(gz)
+		case strings.HasSuffix(path, ".tbi"):
+			idx.lin, err = readTabix(gz)
+		default:
+			idx.lin, err = readCSI(gz)
 		}
-		idx := &Index{crai: cr, path: b}
-		idx.init()
-		nm, err := GetShortName(b, true)
 		if err != nil {
+			log.Printf("error from index: %s", path)
 			panic(err)
 		}
-		return idx, nm, r.i
-	}
-
-	suf := ".bai"
-	if strings.HasSuffix(b, ".bai") {
-		suf = ""
-	}
-  if strings.HasSuffix(b, ".cram") {
-    log.Printf("WARNING: when using CRAM files, send the crai indexes to indexcov, not the alignment files")
-  }
-	rdr, err := os.Open(b + suf)
-	if err != nil {
-		var terr error
-		rdr, terr = os.Open(b[:(len(b)-4)] + suf)
-		if terr != nil {
+	} else {
+		idx.lin, err = readBAI(f)
+		if err != nil {
+			log.Printf("error from index: %s", path)
 			panic(err)
 		}
 	}
+	idx.init()
 
-	dx, err := bam.ReadIndex(bufio.NewReader(rdr))
+	// only a bam has the sample name in the header. indexes use the file name.
+	nm, hdr, err := shortName(b, !strings.HasSuffix(b, ".bam"))
 	if err != nil {
 		panic(err)
 	}
-	idx := &Index{Index: dx, path: b}
-	idx.init()
-	nm, err := GetShortName(b, strings.HasSuffix(b, ".bai"))
-	if err != nil {
-		panic(err)
+	if hdr != nil {
+		idx.hdrPlatform = platformFromHeader(hdr)
+	}
+	if cli.CacheDir != "" {
+		writeCached(cli.CacheDir, b, path, idx, nm)
 	}
 	return idx, nm, r.i
 }
 
+// findIndex returns the path to the index for b which is either a bam or an index.
+func findIndex(b string) string {
+	for _, suf := range []string{".bai", ".csi", ".crai", ".tbi"} {
+		if strings.HasSuffix(b, suf) {
+			return b
+		}
+	}
+	paths := []string{b + ".bai"}
+	if len(b) > 4 {
+		paths = append(paths, b[:len(b)-4]+".bai")
+	}
+	// bams with long chromosomes are indexed with .csi and other bgzipped files with .tbi
+	paths = append(paths, b+".csi", b+".tbi")
+	for _, p := range paths {
+		if existsPath(p) {
+			return p
+		}
+	}
+	return paths[0]
+}
+
 // if there are more samples than this then the depth plots won't be drawn.
 const maxSamples = 100
 
@@ -596,7 +830,8 @@ func normalizeAcrossSamples(depths [][]float32) {
 
 }
 
-func run(refs []*sam.Reference, idxs []*Index, names []string, base string, interSampleNormalize bool) (map[string][]float64, []*counter, [][]uint8, []string, []float32) {
+// run reads the depths for each chromosome from store.
+func run(refs []*sam.Reference, idxs []*Index, store *tileStore, names []string, base string, interSampleNormalize bool) (map[string][]float64, []*counter, [][]uint8, []pcaChrom, []string, []float32, *armCNs, map[string][]float64, *profileCorr, []*tumorPair) {
 	// keep a slice of charts since we plot all of the coverage roc charts in a single html file.
 	sexes := make(map[string][]float64)
 	counts := make([][]int, len(idxs))
@@ -627,7 +862,81 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string, inte
 	defer rtmp.Close()
 	rfh := bufio.NewWriter(rtmp)
 	defer rfh.Flush()
+
+	var sfh *bufio.Writer
+	var pars map[string][][2]int
+	if cli.SexNormalize {
+		stmp, err := getWriter(base + ".sex-raw")
+		if err != nil {
+			panic(err)
+		}
+		defer stmp.Close()
+		sfh = bufio.NewWriter(stmp)
+		defer sfh.Flush()
+		fmt.Fprintf(sfh, "#chrom\tstart\tend\t%s\n", strings.Join(names, "\t"))
+		if pars = getPARs(cli.PAR, refs); pars == nil {
+			log.Println("indexcov: no pseudo-autosomal regions found; scaling entire sex chromosomes")
+		}
+	}
+
+	var cfh *bufio.Writer
+	if cli.CNVMinTiles > 0 {
+		ctmp, err := os.Create(fmt.Sprintf("%s.cnv.bed", base))
+		if err != nil {
+			panic(err)
+		}
+		defer ctmp.Close()
+		cfh = bufio.NewWriter(ctmp)
+		defer cfh.Flush()
+		fmt.Fprintln(cfh, "#chrom\tstart\tend\tsample\tmean_depth\tCN\tn_tiles")
+	}
+	expected := make([]int, len(idxs))
+
+	var hfh *bufio.Writer
+	if len(idxs) >= minHotspotSamples {
+		htmp, err := os.Create(fmt.Sprintf("%s.hotspots.bed", base))
+		if err != nil {
+			panic(err)
+		}
+		defer htmp.Close()
+		hfh = bufio.NewWriter(htmp)
+		defer hfh.Flush()
+	}
+	nHotspots := 0
+
+	var bedPQ, rocPQ *parquetWriter
+	if cli.Parquet {
+		bedPQ, rocPQ = newBedParquet(base+".bed.parquet", names), newROCParquet(base+".roc.parquet", names)
+	}
+	// aucs is the area under the coverage ROC for each sample by chromosome.
+	aucs := make(map[string][]float64)
+	profiles := newProfileCorr(len(idxs))
+	var paired *pairedRatios
+	if cli.Pairs != "" {
+		paired = newPairedRatios(readPairs(cli.Pairs, names), base, genomeWindow(refs, imin(pairMaxPoints, cli.genomePoints)))
+	}
+	genome := newGenomeDepths(refs, len(idxs), cli.genomePoints)
+	var zoom *regionZoom
+	if cli.regions != nil {
+		zoom = newRegionZoom(cli.regions, cli.Genes, names, base)
+	}
+
+	var fa *faidx.Faidx
+	if cli.Fasta != "" {
+		if fa, err = faidx.New(cli.Fasta); err != nil {
+			log.Fatalf("indexcov: error opening fasta %s: %s", cli.Fasta, err)
+		}
+		defer fa.Close()
+	}
+	var mappability map[string][]float64
+	if cli.Mappability != "" {
+		mappability = readMappability(cli.Mappability)
+	}
+
+	arms := &armCNs{}
+	cens := getCentromeres(cli.Centromeres, refs)
 	chromNames := make([]string, 0, len(refs))
+	var layout []pcaChrom
 
 	fmt.Fprintf(bgz, "#chrom\tstart\tend\t%s\n", strings.Join(names, "\t"))
 	ir := -1
@@ -644,16 +953,28 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string, inte
 			}
 			continue
 		}
+		// with --targets, pos holds the bins that are kept for this chromosome and the depths
+		// contain only those bins. chromosomes without any targets are skipped.
+		var pos []int
+		if cli.targets != nil {
+			if ref.ID() >= len(cli.targets) || len(cli.targets[ref.ID()]) == 0 {
+				continue
+			}
+			pos = cli.targets[ref.ID()]
+		}
 		ir++
 		// Some samples may not have all the data, so we always take the longest sample for printing.
 		longest, longesti := 0, 0
 
-		for k, idx := range idxs {
+		store.depths(ref.ID(), depths)
+		for k := range idxs {
+			if pos != nil {
+				depths[k] = gatherBins(depths[k], pos)
+			}
 			if ir == 0 {
-				pca8[k] = make([]uint8, 0, 2e5)
+				pca8[k] = make([]uint8, 0, 2e5/cli.pcaStride)
 				offs[k] = &counter{}
 			}
-			depths[k] = idx.NormalizedDepth(ref.ID())
 			if len(depths[k]) > longest {
 				longesti = k
 				longest = len(depths[k])
@@ -667,45 +988,102 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string, inte
 		}
 		isSex := sameChrom(cli.sex, chrom)
 
-		if interSampleNormalize && !isSex {
-			normalizeAcrossSamples(depths)
+		if fa != nil {
+			if gcs := tileGC(fa, chrom, ref.Len()); gcs != nil {
+				if pos != nil {
+					gcs = gatherBins64(gcs, pos)
+				}
+				debiasDepths(depths, gcs, 0)
+			}
+		}
+		if m, ok := mappability[stripChr(chrom)]; ok {
+			if pos != nil {
+				m = gatherBins64(m, pos)
+			}
+			debiasDepths(depths, m, minMappability)
+		}
+
+		if cli.platformGroups != nil && !isSex {
+			normalizePlatforms(depths, cli.platformGroups)
+		}
+
+		if !isSex {
+			nHotspots += hotspotsThenNormalize(hfh, chrom, depths, pos, interSampleNormalize)
 		}
 
 		for k := range idxs {
 			CountsAtDepth(depths[k], counts[k])
 		}
+		if !isSex {
+			profiles.add(depths, cli.pcaStride)
+		}
 
-		for i := 0; i < len(depths[longesti]); i++ {
-			fmt.Fprintf(bgz, "%s\t%d\t%d\t%s\n", chrom, i*16384, (i+1)*16384, depthsFor(depths, i))
+		if isSex && len(depths[longesti]) > 0 {
+			sexes[chrom] = GetCN(depths)
 		}
 
-		if isSex {
-			if len(depths[longesti]) > 0 {
-				sexes[chrom] = GetCN(depths)
+		out := depths
+		if sfh != nil && isSex && len(sexes[chrom]) > 0 {
+			for i := 0; i < len(depths[longesti]); i++ {
+				fmt.Fprintf(sfh, "%s\t%d\t%d\t%s\n", chrom, binStart(pos, i), binStart(pos, i)+cli.BinSize, depthsFor(depths, i))
 			}
-		} else {
+			out = sexNormalize(depths, sexes[chrom], pars[stripChr(chrom)], pos)
+		}
+		for i := 0; i < len(depths[longesti]); i++ {
+			fmt.Fprintf(bgz, "%s\t%d\t%d\t%s\n", chrom, binStart(pos, i), binStart(pos, i)+cli.BinSize, depthsFor(out, i))
+		}
+		if bedPQ != nil && len(depths[longesti]) > 0 {
+			writeBedParquet(bedPQ, chrom, out, len(depths[longesti]), pos)
+		}
+		if zoom != nil {
+			zoom.add(chrom, out, pos)
+		}
+
+		if !isSex {
 			// now add non-sex chromosomes to the pca data since we know the longest.
-			var dp float32
+			before := len(pca8[0])
+			masked := maskedBins(ref.ID(), pos, longest)
 			for k := range idxs {
-				i := -1 // initalize to -1 to differentiate from never entering loop.
 				dps := depths[k]
-				for i, dp = range dps {
-					// := depths[k][i]
+				for i, dp := range dps {
 					if dp > MaxCN {
-						dp = MaxCN
-						depths[k][i] = dp
+						dps[i] = MaxCN
+					}
+				}
+				for i := 0; i < longest; i += cli.pcaStride {
+					if masked != nil && masked[i] {
+						continue
+					}
+					var dp float32
+					if i < len(dps) {
+						dp = dps[i]
 					}
 					pca8[k] = append(pca8[k], uint8(65535/MaxCN*dp+0.5))
 				}
-				for ; i < longest; i++ {
-					pca8[k] = append(pca8[k], 0)
+				offs[k].count(dps, longest, masked)
+			}
+			layout = append(layout, pcaChrom{Name: chrom, N: len(pca8[0]) - before, Mask: cli.mask.hash(ref.ID()),
+				Targets: cli.targets.hash(ref.ID())})
+		}
+
+		if cfh != nil {
+			for k := range expected {
+				expected[k] = Ploidy
+				if cns, ok := sexes[chrom]; isSex && ok {
+					expected[k] = int(0.5 + cns[k])
 				}
-				offs[k].count(dps, longest)
+			}
+			if !isSex || len(sexes[chrom]) > 0 {
+				writeCNVs(cfh, chrom, depths, names, expected, cli.CNVMinTiles, pos)
 			}
 		}
 
 		if len(depths[longesti]) > 0 {
 			c, rocs := writeROCs(counts, names, chrom, rfh)
+			aucs[chrom] = rocAUC(rocs)
+			if rocPQ != nil {
+				writeROCParquet(rocPQ, chrom, rocs)
+			}
 			// only plot those with at least 3 regions.
 			if (cli.IncludeGL || !strings.HasPrefix(chrom, "GL")) && len(depths[longesti]) > 2 {
 				if !isSex && longest > 100 {
@@ -713,14 +1091,32 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string, inte
 					nSlopes++
 				}
 				chromNames = append(chromNames, chrom)
-				if err := plotDepths(depths, names, chrom, base, len(names) <= maxSamples); err != nil {
+				if paired != nil {
+					paired.add(chrom, ref.Len(), depths, pos, cens)
+				}
+				genome.add(chrom, ref.Len(), depths, pos)
+				if !isSex {
+					if cen, ok := cens[stripChr(chrom)]; ok {
+						arms.add(stripChr(chrom), depths, &cen, pos)
+					} else if cens == nil {
+						arms.add(stripChr(chrom), depths, nil, pos)
+					}
+				}
+				dc, err := plotDepths(depths, pos, names, chrom, base, len(names) <= maxSamples)
+				if err != nil {
 					panic(err)
 				}
+				if report != nil {
+					report.addDepth(chrom, dc, len(names) <= maxSamples, fmt.Sprintf("%s-depth-%s.png", base, chrom))
+				}
 				tmp := chartjs.XFloatFormat
 				chartjs.XFloatFormat = "%.2f"
 				c.Options.Legend = &chartjs.Legend{Display: types.False}
 				link := `<a href="index.html">back to index</a>`
 				saveCharts(fmt.Sprintf("%s-roc-%s.html", base, chrom), "", link, c)
+				if report != nil {
+					report.addROC(chrom, c)
+				}
 				chartjs.XFloatFormat = tmp
 				asPng(fmt.Sprintf("%s-roc-%s.png", base, chrom), c, 4, 3)
 			}
@@ -730,7 +1126,32 @@ func run(refs []*sam.Reference, idxs []*Index, names []string, base string, inte
 		slopes[i] = s / float32(nSlopes)
 	}
 	checkSexes(sexes, cli.sex)
-	return sexes, offs, pca8, chromNames, slopes
+	if hfh != nil {
+		log.Printf("indexcov: found %d bins that are extreme in most samples. see %s.hotspots.bed", nHotspots, base)
+	}
+	for _, pq := range []*parquetWriter{bedPQ, rocPQ} {
+		if pq != nil {
+			if err := pq.close(); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := genome.write(base, names); err != nil {
+		panic(err)
+	}
+	if zoom != nil {
+		if err := zoom.write(base + ".regions.tsv"); err != nil {
+			panic(err)
+		}
+	}
+	var pairs []*tumorPair
+	if paired != nil {
+		if err := paired.close(base); err != nil {
+			panic(err)
+		}
+		pairs = paired.pairs
+	}
+	return sexes, offs, pca8, layout, chromNames, slopes, arms, aucs, profiles, pairs
 }
 
 // updateSlopes adjusts the slopes slice for each sample.
@@ -770,7 +1191,10 @@ func checkSexes(obs map[string][]float64, exp []string) {
 	}
 }
 
-func pca(pca8 [][]uint8, samples []string) (*mat.Dense, []chartjs.Chart, string) {
+func pca(pca8 [][]uint8, layout []pcaChrom, samples []string) (*mat.Dense, []chartjs.Chart, string) {
+	if cli.PCAModel != "" {
+		return projectPCA(pca8, layout, samples)
+	}
 	imat := mat.NewDense(len(pca8), len(pca8[0]), nil)
 	row := make([]float64, len(pca8[0]))
 	for i := 0; i < len(pca8); i++ {
@@ -797,13 +1221,50 @@ func pca(pca8 [][]uint8, samples []string) (*mat.Dense, []chartjs.Chart, string)
 	}
 	vars = vars[:k]
 
-	var proj mat.Dense
-	var dst mat.Dense
-	pc.VectorsTo(&dst)
-	proj.Mul(imat, dst.Slice(0, len(pca8[0]), 0, k))
-	pcaPlots, customjs := plotPCA(&proj, samples, vars)
+	var proj *mat.Dense
+	if cli.SavePCAModel != "" {
+		// the reference samples use the same centered projection as the samples that are
+		// later projected with --pca-model.
+		m := newPCAModel(imat, &pc, k, vars, layout, samples)
+		proj = m.project(imat)
+		if err := m.write(cli.SavePCAModel); err != nil {
+			log.Fatalf("indexcov: error writing PCA model to %s: %s", cli.SavePCAModel, err)
+		}
+		log.Printf("indexcov: wrote PCA model to %s", cli.SavePCAModel)
+	} else {
+		var dst mat.Dense
+		pc.VectorsTo(&dst)
+		proj = &mat.Dense{}
+		proj.Mul(imat, dst.Slice(0, len(pca8[0]), 0, k))
+	}
+	pcaPlots, customjs := plotPCA(proj, samples, vars, backgroundN)
+
+	return proj, pcaPlots, customjs
+}
 
-	return &proj, pcaPlots, customjs
+// projectPCA projects samples onto the PCs from --pca-model. The plots show the reference
+// samples in gray with the projected samples over them.
+func projectPCA(pca8 [][]uint8, layout []pcaChrom, samples []string) (*mat.Dense, []chartjs.Chart, string) {
+	m, err := readPCAModel(cli.PCAModel)
+	if err != nil {
+		log.Fatalf("indexcov: error reading PCA model from %s: %s", cli.PCAModel, err)
+	}
+	if m.k() < 3 {
+		log.Printf("indexcov: %d principal components in model, not plotting", m.k())
+		return nil, nil, ""
+	}
+	imat, err := m.align(pca8, layout)
+	if err != nil {
+		log.Fatalf("indexcov: error using PCA model from %s: %s", cli.PCAModel, err)
+	}
+	proj := m.project(imat)
+	nRef := len(m.Samples)
+	r, k := proj.Dims()
+	all := mat.NewDense(nRef+r, k, nil)
+	all.Slice(0, nRef, 0, k).(*mat.Dense).Copy(mat.NewDense(nRef, k, m.Projections))
+	all.Slice(nRef, nRef+r, 0, k).(*mat.Dense).Copy(proj)
+	pcaPlots, customjs := plotPCA(all, append(append([]string{}, m.Samples...), samples...), m.Vars, nRef+backgroundN)
+	return proj, pcaPlots, customjs
 }
 
 func getBase(directory string) string {
@@ -812,13 +1273,17 @@ func getBase(directory string) string {
 }
 
 // write an index.html and a ped file. includes the PC projections and inferred sexes.
-func writeIndex(sexes map[string][]float64, counts []*counter, samples []string, directory string, pca8 [][]uint8, slopes []float32,
-	chromNames []string, mapped []uint64, unmapped []uint64) string {
+func writeIndex(sexes map[string][]float64, counts []*counter, samples []string, directory string, pca8 [][]uint8, layout []pcaChrom, slopes []float32,
+	chromNames []string, mapped []uint64, unmapped []uint64, offTarget []float64, bytesPerRead []float64, arms *armCNs, aucs map[string][]float64, profiles *profileCorr, pairs []*tumorPair) string {
 	if len(sexes) == 0 {
 		log.Println("sex chromosomes not found.")
 	}
-	pcs, pcaPlots, pcajs := pca(pca8, samples)
+	pcs, pcaPlots, pcajs := pca(pca8, layout, samples)
 	binChart, binjs := plotBins(counts, samples)
+	qc := qcSamples(samples, counts, slopes, pcs, cli.QCZ, cli.QCDistance)
+	if err := writeQCJSON(fmt.Sprintf("%s.qc.json", getBase(directory)), qc, cli.QCZ, cli.QCDistance); err != nil {
+		panic(err)
+	}
 
 	sexes["_inferred"] = make([]float64, len(samples))
 	f, err := os.Create(fmt.Sprintf("%s.ped", getBase(directory)))
@@ -850,10 +1315,23 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 		hdr = append(hdr, "mapped")
 		hdr = append(hdr, "unmapped")
 	}
+	hdr = append(hdr, "qc_pass", "qc_reasons", "platform")
+	// with --ped, the family and parents are taken from the user's file and the declared sex is checked.
+	var peds map[string]*pedSample
+	var discordant []bool
+	if cli.Ped != "" {
+		peds = readPed(cli.Ped)
+		discordant = make([]bool, len(samples))
+		hdr = append(hdr, "sex_discordant")
+	}
+	if offTarget != nil {
+		hdr = append(hdr, "off_target")
+	}
 
 	fmt.Fprintf(f, "#family_id\tsample_id\tpaternal_id\tmaternal_id\tsex\tphenotype\t%s\n", strings.Join(hdr, "\t"))
-	tmpl := "unknown\t%s\t-9\t-9\t%d\t-9\t"
+	tmpl := "%s\t%s\t%s\t%s\t%d\t-9\t"
 	var inferred int
+	var missing []string
 	for i, s := range samples {
 		if counts[i] == nil {
 			continue
@@ -863,7 +1341,14 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 		} else {
 			inferred = -9
 		}
-		fmt.Fprintf(f, tmpl, s, inferred)
+		family, paternal, maternal := "unknown", "-9", "-9"
+		if ped, ok := peds[s]; ok {
+			family, paternal, maternal = ped.Family, ped.Paternal, ped.Maternal
+			discordant[i] = ped.sexDiscordant(inferred)
+		} else if peds != nil {
+			missing = append(missing, s)
+		}
+		fmt.Fprintf(f, tmpl, family, s, paternal, maternal, inferred)
 		sexes["_inferred"][i] = float64(inferred)
 		s := make([]string, 0, len(keys)+4)
 		for _, k := range keys {
@@ -889,14 +1374,33 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 			s = append(s, strconv.Itoa(int(mapped[i])))
 			s = append(s, strconv.Itoa(int(unmapped[i])))
 		}
+		s = append(s, qcColumns(qc[i], len(samples))...)
+		s = append(s, cli.platforms[i])
+		if peds != nil {
+			s = append(s, strconv.FormatBool(discordant[i]))
+		}
+		if offTarget != nil {
+			s = append(s, fmt.Sprintf("%.3f", offTarget[i]))
+		}
 
 		fmt.Fprintln(f, strings.Join(s, "\t"))
 	}
+	if err := writeSummaryJSON(fmt.Sprintf("%s.summary.json", getBase(directory)), samples, sexes, keys, counts, slopes, pcs,
+		mapped, unmapped, aucs, chromNames, qc, discordant, offTarget, bytesPerRead); err != nil {
+		panic(err)
+	}
+	if len(missing) > 0 {
+		log.Printf("indexcov: %d sample(s) not found in %s: %s", len(missing), cli.Ped, strings.Join(missing, ","))
+	}
+	dups, sexChecks, err := profiles.write(fmt.Sprintf("%s.relatedness.tsv", getBase(directory)), samples, sexes["_inferred"], peds)
+	if err != nil {
+		panic(err)
+	}
 	var sexChart *chartjs.Chart
 	var sexjs string
 
 	if len(keys) > 1 && len(sexes) > 1 {
-		sexChart, sexjs, err = plotSex(sexes, keys[:2], samples)
+		sexChart, sexjs, err = plotSex(sexes, keys[:2], samples, discordant)
 		if err != nil {
 			panic(err)
 		}
@@ -905,7 +1409,7 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 	var mapChart *chartjs.Chart
 	var mapjs string
 	if mapped != nil {
-		mapChart, mapjs, err = plotMapped(mapped, unmapped, samples)
+		mapChart, mapjs, err = plotMapped(mapped, unmapped, samples, mappedUnits())
 		if err != nil {
 			panic(err)
 		}
@@ -919,6 +1423,22 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 	if sexChart != nil {
 		asPng(fmt.Sprintf("%s-sex.png", getBase(directory)), *sexChart, 6, 6)
 	}
+	if mapChart != nil {
+		asStatic(fmt.Sprintf("%s-mapped.png", getBase(directory)), *mapChart, 6, 6)
+	}
+	asStatic(fmt.Sprintf("%s-bins.png", getBase(directory)), binChart, 6, 6)
+	for i, c := range pcaPlots {
+		asStatic(fmt.Sprintf("%s-pca-pc%d.png", getBase(directory), i+2), c, 6, 6)
+	}
+	hasArms := arms != nil && len(arms.arms) > 0
+	if hasArms {
+		if err := arms.write(fmt.Sprintf("%s.arms.tsv", getBase(directory)), samples); err != nil {
+			panic(err)
+		}
+		if err := arms.plot(fmt.Sprintf("%s-arms.png", getBase(directory)), samples); err != nil {
+			panic(err)
+		}
+	}
 
 	chartMap := map[string]interface{}{"pcajs": template.JS(pcajs), "pcbjs": template.JS(pcajs),
 		"template": chartTemplate,
@@ -941,14 +1461,36 @@ func writeIndex(sexes map[string][]float64, counts []*counter, samples []string,
 		chartMap["pca"] = pcaPlots[0]
 		chartMap["pcb"] = pcaPlots[1]
 		chartMap["hasPCA"] = true
+		chartMap["pcaModel"] = cli.PCAModel
 	} else {
 		chartMap["hasPCA"] = false
 	}
 	chartMap["notmany"] = len(samples) <= maxSamples
+	chartMap["hasCNV"] = cli.CNVMinTiles > 0
+	chartMap["hasArms"] = hasArms
+	failed := make([]qcSample, 0, 4)
+	for _, q := range qc {
+		if !q.Pass {
+			failed = append(failed, q)
+		}
+	}
+	chartMap["qcFailed"] = failed
+	chartMap["hasQC"] = len(samples) >= minQCSamples
+	chartMap["binSize"] = cli.BinSize
+	chartMap["hasRelatedness"] = profiles.tiles > 1 || cli.Ped != ""
+	chartMap["duplicates"] = dups
+	chartMap["sexDiscordant"] = sexChecks
+	chartMap["pairs"] = pairs
+	chartMap["samples"] = genomeSamples(samples, qc, discordant)
+	chartMap["regions"] = cli.regions
 	if err := chartjs.SaveCharts(wtr, chartMap, chartjs.Chart{}); err != nil {
 		panic(err)
 	}
 	wtr.Close()
+	if report != nil {
+		report.writeSingleHTML(fmt.Sprintf("%s-report.html", getBase(directory)), chartMap,
+			fmt.Sprintf("%s.ped", getBase(directory)), fmt.Sprintf("%s-arms.png", getBase(directory)))
+	}
 	return indexPath
 }
 
@@ -1058,10 +1600,18 @@ type counter struct {
 	in int
 }
 
-// count values in or out of expected range of ~1.
-func (c *counter) count(depths []float32, n int) {
-	var i int
-	for ; i < len(depths); i++ {
+// count values in or out of expected range of ~1. Values past the end of depths are counted as low.
+// Values where masked is true are not counted; masked may be nil.
+func (c *counter) count(depths []float32, n int, masked []bool) {
+	for i := 0; i < n; i++ {
+		if masked != nil && masked[i] {
+			continue
+		}
+		if i >= len(depths) {
+			c.out++
+			c.low++
+			continue
+		}
 		if depths[i] < 0.85 || depths[i] > 1.15 {
 			c.out++
 			if depths[i] > 1.15 {
@@ -1073,6 +1623,4 @@ func (c *counter) count(depths []float32, n int) {
 			c.in++
 		}
 	}
-	c.out += n - i
-	c.low += n - i
 }
@@ -0,0 +1,255 @@
+package indexcov
+
+import (
+	"fmt"
+	"html/template"
+	"image/color"
+	"math"
+	"os"
+
+	"github.com/biogo/hts/sam"
+	chartjs "github.com/brentp/go-chartjs"
+	"github.com/brentp/go-chartjs/types"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// genomeMaxPoints is the approximate maximum number of points in the genome-wide plot of each sample.
+// Adjacent bins are averaged to stay under this.
+const genomeMaxPoints = 10000
+
+// genomeColors alternate between chromosomes in the genome-wide plots.
+var genomeColors = []*types.RGBA{{R: 31, G: 119, B: 180, A: 240}, {R: 255, G: 127, B: 14, A: 240}}
+
+// genomeChrom is the offset of a chromosome in the genome-wide plots.
+type genomeChrom struct {
+	Name          string
+	Start, Length int
+}
+
+// genomeSample is a row in the sample table of index.html that links to the genome-wide plot.
+type genomeSample struct {
+	Sample string
+	// File is the sample name used in the paths of the plots.
+	File string
+	// Flags are the QC reasons and sex discordance for the sample.
+	Flags []string
+}
+
+// genomeSamples returns the rows of the sample table with the QC reasons and whether the declared sex is
+// discordant. discordant may be nil. Background samples are not included.
+func genomeSamples(samples []string, qc []qcSample, discordant []bool) []genomeSample {
+	rows := make([]genomeSample, 0, len(samples))
+	for i := backgroundN; i < len(samples); i++ {
+		row := genomeSample{Sample: samples[i], File: unsafeName.ReplaceAllString(samples[i], "_")}
+		if i < len(qc) {
+			row.Flags = append(row.Flags, qc[i].Reasons...)
+		}
+		if discordant != nil && discordant[i] {
+			row.Flags = append(row.Flags, "sex discordant")
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// genomeDepths keeps the mean scaled depth of windows of adjacent bins for each sample one chromosome at a
+// time for the genome-wide plots.
+type genomeDepths struct {
+	// window is the number of bins that are averaged for each point.
+	window int
+	chroms []genomeChrom
+	offset int
+	// xs are the genome-wide positions of the points. ends has the index in xs where each chromosome ends.
+	xs   []float64
+	ends []int
+	ys   [][]float32
+}
+
+// newGenomeDepths sets the window so that the bins of all of the refs (or of --targets) give about
+// points points for each of the n samples.
+func newGenomeDepths(refs []*sam.Reference, n int, points int) *genomeDepths {
+	return &genomeDepths{window: genomeWindow(refs, points), ys: make([][]float32, n)}
+}
+
+// genomeWindow returns the number of adjacent bins to average so that the bins of all of the refs (or of
+// --targets) give about points points.
+func genomeWindow(refs []*sam.Reference, points int) int {
+	bins := 0
+	for _, ref := range refs {
+		if cli.targets != nil {
+			if ref.ID() < len(cli.targets) {
+				bins += len(cli.targets[ref.ID()])
+			}
+			continue
+		}
+		bins += (ref.Len() + cli.BinSize - 1) / cli.BinSize
+	}
+	if points < 1 {
+		points = 1
+	}
+	return 1 + bins/points
+}
+
+// add averages the depths of each sample for chrom in windows. pos holds the bins of the depths with --targets.
+func (g *genomeDepths) add(chrom string, length int, depths [][]float32, pos []int) {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	for j := 0; j < longest; j += g.window {
+		end := imin(j+g.window, longest)
+		g.xs = append(g.xs, float64(g.offset+(binStart(pos, j)+binStart(pos, end-1)+cli.BinSize)/2))
+		for k, d := range depths {
+			var sum float32
+			n := 0
+			for i := j; i < end && i < len(d); i++ {
+				sum += d[i]
+				n++
+			}
+			v := float32(math.NaN())
+			if n > 0 {
+				v = sum / float32(n)
+			}
+			g.ys[k] = append(g.ys[k], v)
+		}
+	}
+	g.ends = append(g.ends, len(g.xs))
+	g.chroms = append(g.chroms, genomeChrom{Name: chrom, Start: g.offset, Length: length})
+	g.offset += length
+}
+
+// chromValues returns the points of sample k for the i'th chromosome with the depths capped at cnMax.
+// If mb is true, the positions are in megabases.
+func (g *genomeDepths) chromValues(k, i int, mb bool) *vs {
+	start := 0
+	if i > 0 {
+		start = g.ends[i-1]
+	}
+	v := &vs{xs: make([]float64, 0, g.ends[i]-start), ys: make([]float64, 0, g.ends[i]-start)}
+	for j := start; j < g.ends[i]; j++ {
+		y := float64(g.ys[k][j])
+		if math.IsNaN(y) {
+			continue
+		}
+		x := g.xs[j]
+		if mb {
+			x /= 1e6
+		}
+		v.xs = append(v.xs, x)
+		v.ys = append(v.ys, math.Min(y, cnMax))
+	}
+	return v
+}
+
+// write saves the static genome-wide plot of each sample that is not a background. The interactive
+// plots are only written for up to maxSamples samples.
+func (g *genomeDepths) write(base string, samples []string) error {
+	link := template.HTML(`<a href="index.html">back to index</a>`)
+	for k := backgroundN; k < len(samples); k++ {
+		path := fmt.Sprintf("%s-sample-%s", base, unsafeName.ReplaceAllString(samples[k], "_"))
+		if len(samples) <= maxSamples {
+			wtr, err := os.Create(path + ".html")
+			if err != nil {
+				return err
+			}
+			chart := g.chart(k, samples[k])
+			if err := chart.SaveHTML(wtr, map[string]interface{}{"width": 1200, "height": 450, "customHTML": link}); err != nil {
+				return err
+			}
+			if err := wtr.Close(); err != nil {
+				return err
+			}
+		}
+		if err := g.plot(k, samples[k], path+".png"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chart returns an interactive plot of the depth of sample k across the genome with a dataset for
+// each chromosome so that the chromosome is shown when hovering.
+func (g *genomeDepths) chart(k int, sample string) chartjs.Chart {
+	chart := chartjs.Chart{Label: sample}
+	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "genome position (Mb)", Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left,
+		Tick:       &chartjs.Tick{Min: 0, Max: cnMax},
+		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "scaled coverage for " + sample, Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	for i, c := range g.chroms {
+		col := genomeColors[i%len(genomeColors)]
+		ds := chartjs.Dataset{Data: g.chromValues(k, i, true), Label: c.Name, Fill: chartjs.False, PointRadius: 1.5, BorderWidth: 0,
+			BorderColor: col, BackgroundColor: col, PointBackgroundColor: col, ShowLine: chartjs.False, PointHitRadius: 3}
+		ds.XAxisID, ds.YAxisID = xa, ya
+		chart.AddDataset(ds)
+	}
+	chart.Options.Responsive = chartjs.False
+	chart.Options.Legend = &chartjs.Legend{Display: chartjs.False}
+	chart.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
+	return chart
+}
+
+// plot saves a static plot of the depth of sample k across the genome with the chromosomes labeled.
+func (g *genomeDepths) plot(k int, sample string, path string) error {
+	pl := plot.New()
+	pl.Title.Text = sample
+	pl.Y.Label.Text = "scaled coverage"
+	if err := genomeAxis(pl, g.chroms, 0, cnMax); err != nil {
+		return err
+	}
+	for i := range g.chroms {
+		v := g.chromValues(k, i, false)
+		if v.Len() == 0 {
+			continue
+		}
+		sc, err := plotter.NewScatter(v)
+		if err != nil {
+			return err
+		}
+		c := color.RGBA(*genomeColors[i%len(genomeColors)])
+		c.A = 255
+		sc.GlyphStyle.Radius = vg.Points(0.8)
+		sc.GlyphStyle.Color = c
+		pl.Add(sc)
+	}
+	return savePlot(pl, path, 10*vg.Inch, 4*vg.Inch, true)
+}
+
+// genomeAxis labels the x-axis of a genome-wide plot with the chromosomes and draws a line between each
+// from ymin to ymax.
+func genomeAxis(pl *plot.Plot, chroms []genomeChrom, ymin, ymax float64) error {
+	pl.Y.Min, pl.Y.Max = ymin, ymax
+	ticks := make([]plot.Tick, 0, len(chroms))
+	for i, c := range chroms {
+		ticks = append(ticks, plot.Tick{Value: float64(c.Start + c.Length/2), Label: stripChr(c.Name)})
+		if i == 0 {
+			continue
+		}
+		l, err := plotter.NewLine(plotter.XYs{{X: float64(c.Start), Y: ymin}, {X: float64(c.Start), Y: ymax}})
+		if err != nil {
+			return err
+		}
+		l.Color = color.Gray{Y: 200}
+		pl.Add(l)
+	}
+	pl.X.Tick.Marker = plot.ConstantTicks(ticks)
+	pl.X.Tick.Label.Rotation = math.Pi / 2
+	pl.X.Tick.Label.XAlign = draw.XRight
+	pl.X.Tick.Label.YAlign = draw.YCenter
+	pl.X.Min = 0
+	if len(chroms) > 0 {
+		last := chroms[len(chroms)-1]
+		pl.X.Max = float64(last.Start + last.Length)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/biogo/hts/bgzf"
+	chartjs "github.com/brentp/go-chartjs"
+	"github.com/brentp/go-chartjs/types"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// pairLog2Threshold is the minimum absolute log2 ratio of a segment or arm for it to be called a gain or loss.
+// It is not adjusted for purity so calls are a screen rather than copy-number estimates.
+const pairLog2Threshold = 0.15
+
+// pairMinNormal is the minimum scaled depth in the normal for a bin to be used.
+const pairMinNormal = 0.2
+
+// pairMaxLog2 caps the log2 ratio so that bins with no coverage in the tumor do not dominate.
+const pairMaxLog2 = 3
+
+// pairMaxPoints is the approximate maximum number of points in the genome-wide plot of each pair.
+// Adjacent bins are averaged to stay under this.
+const pairMaxPoints = 20000
+
+// tumorPair is a tumor and its matched normal from --pairs.
+type tumorPair struct {
+	Tumor, Normal string
+	// t and n are the indexes of the tumor and normal in the samples.
+	t, n int
+	// Gains and Losses are the arms with a median log2 ratio beyond pairLog2Threshold.
+	Gains, Losses []string
+}
+
+// Name is used in the paths of the output files for the pair. Characters that are not safe in paths are
+// replaced with "_".
+func (p *tumorPair) Name() string {
+	return unsafeName.ReplaceAllString(p.Tumor+"-vs-"+p.Normal, "_")
+}
+
+// readPairs reads the tumor and normal sample names from the first 2 columns of path.
+// Lines starting with '#' are skipped.
+func readPairs(path string, samples []string) []*tumorPair {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("indexcov: error opening pairs file %s: %s", path, err)
+	}
+	defer f.Close()
+	lookup := make(map[string]int, len(samples))
+	for i, s := range samples {
+		lookup[s] = i
+	}
+	var pairs []*tumorPair
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		toks := strings.Fields(line)
+		if len(toks) < 2 {
+			log.Fatalf("indexcov: expected tumor and normal columns in pairs file %s, got: %s", path, line)
+		}
+		t, tok := lookup[toks[0]]
+		n, nok := lookup[toks[1]]
+		if !tok || !nok {
+			log.Fatalf("indexcov: samples in pairs file %s must be in: %s. got: %s", path, strings.Join(samples, ","), line)
+		}
+		pairs = append(pairs, &tumorPair{Tumor: toks[0], Normal: toks[1], t: t, n: n})
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatalf("indexcov: error reading pairs file %s: %s", path, err)
+	}
+	return pairs
+}
+
+// log2Ratios returns the log2 of tumor over normal for each bin. Bins where the normal is below
+// pairMinNormal are NaN.
+func log2Ratios(tumor, normal []float32) []float64 {
+	n := len(tumor)
+	if len(normal) > n {
+		n = len(normal)
+	}
+	ratios := make([]float64, n)
+	for i := range ratios {
+		if i >= len(normal) || normal[i] < pairMinNormal {
+			ratios[i] = math.NaN()
+			continue
+		}
+		var t float64
+		if i < len(tumor) {
+			t = float64(tumor[i])
+		}
+		r := math.Log2(t / float64(normal[i]))
+		ratios[i] = math.Max(-pairMaxLog2, math.Min(pairMaxLog2, r))
+	}
+	return ratios
+}
+
+// pairCall returns "gain", "loss" or "neutral" for a log2 ratio.
+func pairCall(v float64) string {
+	if v > pairLog2Threshold {
+		return "gain"
+	}
+	if v < -pairLog2Threshold {
+		return "loss"
+	}
+	return "neutral"
+}
+
+// pairedRatios writes the log2 ratios of each tumor/normal pair one chromosome at a time and keeps
+// the arm-level ratios and the values for the genome-wide plots.
+type pairedRatios struct {
+	pairs []*tumorPair
+	beds  []*bufio.Writer
+	bgzfs []*bgzf.Writer
+	segf  *os.File
+	seg   *bufio.Writer
+	arms  []string
+	// meds is parallel to arms and has the median log2 ratio for each pair.
+	meds   [][]float64
+	chroms []genomeChrom
+	offset int
+	// window is the number of bins that are averaged for each point in ratios.
+	window int
+	// ratios and segs are the genome-wide values for each pair with x as the offset position.
+	ratios []*vs
+	segs   [][]segment
+}
+
+// newPairedRatios creates the per-pair .bed.gz files and the segment file. window bins are averaged
+// for each point in the plots.
+func newPairedRatios(pairs []*tumorPair, base string, window int) *pairedRatios {
+	p := &pairedRatios{pairs: pairs, window: window, ratios: make([]*vs, len(pairs)), segs: make([][]segment, len(pairs))}
+	for i, pr := range pairs {
+		z, err := getWriter(fmt.Sprintf("%s-pair-%s.log2", base, pr.Name()))
+		if err != nil {
+			panic(err)
+		}
+		w := bufio.NewWriter(z)
+		fmt.Fprintf(w, "#chrom\tstart\tend\tlog2(%s/%s)\n", pr.Tumor, pr.Normal)
+		p.bgzfs, p.beds = append(p.bgzfs, z), append(p.beds, w)
+		p.ratios[i] = &vs{}
+	}
+	var err error
+	if p.segf, err = os.Create(fmt.Sprintf("%s-pairs.seg.bed", base)); err != nil {
+		panic(err)
+	}
+	p.seg = bufio.NewWriter(p.segf)
+	fmt.Fprintln(p.seg, "#chrom\tstart\tend\ttumor\tnormal\tlog2_ratio\tn_tiles\tcall")
+	return p
+}
+
+// add writes the log2 ratios and segments of each pair for a chromosome. Arms are split by the centromeres
+// in cens. If cens is nil, the entire chromosome is used and if cens does not have chrom, no arm is added.
+func (p *pairedRatios) add(chrom string, length int, depths [][]float32, pos []int, cens map[string][2]int) {
+	all := make([][]float64, len(p.pairs))
+	for k, pr := range p.pairs {
+		ratios := log2Ratios(depths[pr.t], depths[pr.n])
+		all[k] = ratios
+		idx := make([]int, 0, len(ratios))
+		vals := make([]float64, 0, len(ratios))
+		for i, r := range ratios {
+			if math.IsNaN(r) {
+				continue
+			}
+			idx = append(idx, i)
+			vals = append(vals, r)
+			s := binStart(pos, i)
+			fmt.Fprintf(p.beds[k], "%s\t%d\t%d\t%.3f\n", chrom, s, s+cli.BinSize, r)
+		}
+		p.addPoints(k, ratios, pos)
+		segs := segmentValues(idx, vals, cli.PairMinTiles, func(a, b segment) bool { return pairCall(a.mean) == pairCall(b.mean) })
+		for _, s := range segs {
+			start, end := binStart(pos, s.start), binStart(pos, s.end-1)+cli.BinSize
+			fmt.Fprintf(p.seg, "%s\t%d\t%d\t%s\t%s\t%.3f\t%d\t%s\n", chrom, start, end, pr.Tumor, pr.Normal, s.mean, s.n, pairCall(s.mean))
+			// keep genome-wide positions for plotting.
+			s.start, s.end = p.offset+start, p.offset+end
+			p.segs[k] = append(p.segs[k], s)
+		}
+	}
+	p.chroms = append(p.chroms, genomeChrom{Name: chrom, Start: p.offset, Length: length})
+	p.offset += length
+
+	name := stripChr(chrom)
+	if cen, ok := cens[name]; ok {
+		ps, qs := searchBins(pos, cen[0]/cli.BinSize), searchBins(pos, (cen[1]+cli.BinSize-1)/cli.BinSize)
+		pr, qr := make([][]float64, len(all)), make([][]float64, len(all))
+		for k, r := range all {
+			pr[k], qr[k] = r[:imin(ps, len(r))], r[imin(qs, len(r)):]
+		}
+		p.addArm(name+"p", pr)
+		p.addArm(name+"q", qr)
+	} else if cens == nil {
+		p.addArm(name, all)
+	}
+}
+
+// addPoints adds the mean of the ratios in each window of bins to the genome-wide values of pair k.
+// Windows where every ratio is NaN are skipped.
+func (p *pairedRatios) addPoints(k int, ratios []float64, pos []int) {
+	for j := 0; j < len(ratios); j += p.window {
+		end := imin(j+p.window, len(ratios))
+		var sum float64
+		n := 0
+		for _, r := range ratios[j:end] {
+			if !math.IsNaN(r) {
+				sum += r
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		p.ratios[k].xs = append(p.ratios[k].xs, float64(p.offset+(binStart(pos, j)+binStart(pos, end-1)+cli.BinSize)/2))
+		p.ratios[k].ys = append(p.ratios[k].ys, sum/float64(n))
+	}
+}
+
+// addArm adds the median log2 ratio of each pair for an arm. Arms without values in any pair are skipped.
+func (p *pairedRatios) addArm(name string, ratios [][]float64) {
+	meds := make([]float64, len(ratios))
+	found := false
+	for k, r := range ratios {
+		vals := make([]float64, 0, len(r))
+		for _, v := range r {
+			if !math.IsNaN(v) {
+				vals = append(vals, v)
+			}
+		}
+		if len(vals) == 0 {
+			meds[k] = math.NaN()
+			continue
+		}
+		sort.Float64s(vals)
+		meds[k] = vals[len(vals)/2]
+		found = true
+	}
+	if !found {
+		return
+	}
+	p.arms = append(p.arms, name)
+	p.meds = append(p.meds, meds)
+	for k, pr := range p.pairs {
+		switch pairCall(meds[k]) {
+		case "gain":
+			pr.Gains = append(pr.Gains, name)
+		case "loss":
+			pr.Losses = append(pr.Losses, name)
+		}
+	}
+}
+
+// close finishes the per-pair files and writes the arm-level ratios and the plots for each pair.
+func (p *pairedRatios) close(base string) error {
+	for k := range p.pairs {
+		if err := p.beds[k].Flush(); err != nil {
+			return err
+		}
+		if err := p.bgzfs[k].Close(); err != nil {
+			return err
+		}
+	}
+	if err := p.seg.Flush(); err != nil {
+		return err
+	}
+	if err := p.segf.Close(); err != nil {
+		return err
+	}
+	if err := p.writeArms(fmt.Sprintf("%s-pairs.arms.tsv", base)); err != nil {
+		return err
+	}
+	for k, pr := range p.pairs {
+		path := fmt.Sprintf("%s-pair-%s", base, pr.Name())
+		c := p.chart(k)
+		link := `<a href="index.html">back to index</a>`
+		saveCharts(path+".html", "", link, c)
+		if err := p.plot(k, path+".png"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArms writes a matrix of pairs by arms with the median log2 ratio.
+func (p *pairedRatios) writeArms(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#tumor\tnormal\t%s\tgains\tlosses\n", strings.Join(p.arms, "\t"))
+	vals := make([]string, len(p.arms))
+	for k, pr := range p.pairs {
+		for j := range p.arms {
+			if math.IsNaN(p.meds[j][k]) {
+				vals[j] = "NA"
+			} else {
+				vals[j] = fmt.Sprintf("%.3f", p.meds[j][k])
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pr.Tumor, pr.Normal, strings.Join(vals, "\t"), orNA(pr.Gains), orNA(pr.Losses))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// chart returns an interactive plot of the genome-wide log2 ratios with the segments over them.
+func (p *pairedRatios) chart(k int) chartjs.Chart {
+	pr := p.pairs[k]
+	chart := chartjs.Chart{Label: pr.Name()}
+	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "genome position (Mb)", Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left,
+		Tick:       &chartjs.Tick{Min: -2, Max: 2},
+		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: fmt.Sprintf("log2(%s/%s)", pr.Tumor, pr.Normal), Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	r := p.ratios[k]
+	pts := &vs{xs: make([]float64, len(r.xs)), ys: r.ys}
+	for i, x := range r.xs {
+		pts.xs[i] = x / 1e6
+	}
+	segs := &vs{}
+	for _, s := range p.segs[k] {
+		segs.xs = append(segs.xs, float64(s.start)/1e6, float64(s.end)/1e6)
+		segs.ys = append(segs.ys, s.mean, s.mean)
+	}
+	gray := &types.RGBA{R: 150, G: 150, B: 150, A: 150}
+	red := &types.RGBA{R: 220, G: 30, B: 30, A: 240}
+	ds := chartjs.Dataset{Data: segs, Label: "segments", Fill: chartjs.False, PointRadius: 0, BorderWidth: 2,
+		BorderColor: red, BackgroundColor: red, PointHitRadius: 6}
+	ds.XAxisID, ds.YAxisID = xa, ya
+	chart.AddDataset(ds)
+	ds = chartjs.Dataset{Data: pts, Label: "bins", Fill: chartjs.False, PointRadius: 1, BorderWidth: 0,
+		BorderColor: gray, BackgroundColor: gray, PointBackgroundColor: gray, ShowLine: chartjs.False, PointHitRadius: 2}
+	ds.XAxisID, ds.YAxisID = xa, ya
+	chart.AddDataset(ds)
+	chart.Options.Responsive = chartjs.False
+	chart.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
+	return chart
+}
+
+// plot saves a static genome-wide plot of the log2 ratios and segments with the chromosomes labeled.
+func (p *pairedRatios) plot(k int, path string) error {
+	pr := p.pairs[k]
+	pl := plot.New()
+	pl.Title.Text = pr.Name()
+	pl.Y.Label.Text = "log2 ratio"
+	if err := genomeAxis(pl, p.chroms, -2, 2); err != nil {
+		return err
+	}
+
+	r := p.ratios[k]
+	if r.Len() > 0 {
+		pts := &vs{xs: r.xs, ys: make([]float64, len(r.ys))}
+		for i, y := range r.ys {
+			pts.ys[i] = math.Max(-2, math.Min(2, y))
+		}
+		sc, err := plotter.NewScatter(pts)
+		if err != nil {
+			return err
+		}
+		sc.GlyphStyle.Radius = vg.Points(0.6)
+		sc.GlyphStyle.Color = color.Gray{Y: 120}
+		pl.Add(sc)
+	}
+	for _, s := range p.segs[k] {
+		y := math.Max(-2, math.Min(2, s.mean))
+		l, err := plotter.NewLine(plotter.XYs{{X: float64(s.start), Y: y}, {X: float64(s.end), Y: y}})
+		if err != nil {
+			return err
+		}
+		l.Color = color.RGBA{R: 220, G: 30, B: 30, A: 255}
+		l.Width = vg.Points(2)
+		pl.Add(l)
+	}
+	return savePlot(pl, path, 10*vg.Inch, 4*vg.Inch, true)
+}
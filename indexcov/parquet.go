@@ -0,0 +1,347 @@
+package indexcov
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/brentp/goleft"
+)
+
+// parquet physical types.
+const (
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// parquetColumn is a required column in a flat parquet schema. Strings are UTF8 byte arrays.
+type parquetColumn struct {
+	name string
+	typ  int32
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	n      int64
+}
+
+// parquetWriter writes a flat table of required columns to a parquet file. Each call to write
+// adds a row group so that the table can be written one chromosome at a time. Values are PLAIN
+// encoded and uncompressed which keeps the writer small and is read by pyarrow, DuckDB and others.
+type parquetWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	off    int64
+	cols   []parquetColumn
+	groups [][]parquetChunk
+	nRows  int64
+}
+
+func newParquetWriter(path string, cols []parquetColumn) (*parquetWriter, error) {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.name
+	}
+	if d := firstDuplicate(names); d != "" {
+		return nil, fmt.Errorf("parquet: duplicate column %s", d)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &parquetWriter{f: f, w: bufio.NewWriter(f), cols: cols}
+	p.put([]byte("PAR1"))
+	return p, nil
+}
+
+func (p *parquetWriter) put(b []byte) {
+	p.w.Write(b)
+	p.off += int64(len(b))
+}
+
+// write adds a row group with one slice per column. Each slice must be []string, []int64,
+// []float32 or []float64 to match the column type and all must have the same length.
+func (p *parquetWriter) write(columns ...interface{}) error {
+	if len(columns) != len(p.cols) {
+		return fmt.Errorf("parquet: expected %d columns, got %d", len(p.cols), len(columns))
+	}
+	n := -1
+	chunks := make([]parquetChunk, len(columns))
+	for i, col := range columns {
+		var data []byte
+		var m int
+		switch v := col.(type) {
+		case []string:
+			m = len(v)
+			for _, s := range v {
+				data = binary.LittleEndian.AppendUint32(data, uint32(len(s)))
+				data = append(data, s...)
+			}
+		case []int64:
+			m = len(v)
+			for _, x := range v {
+				data = binary.LittleEndian.AppendUint64(data, uint64(x))
+			}
+		case []float32:
+			m = len(v)
+			for _, x := range v {
+				data = binary.LittleEndian.AppendUint32(data, math.Float32bits(x))
+			}
+		case []float64:
+			m = len(v)
+			for _, x := range v {
+				data = binary.LittleEndian.AppendUint64(data, math.Float64bits(x))
+			}
+		default:
+			return fmt.Errorf("parquet: unsupported column type %T", col)
+		}
+		if n == -1 {
+			n = m
+		} else if m != n {
+			return fmt.Errorf("parquet: column %s has %d values, expected %d", p.cols[i].name, m, n)
+		}
+		var t thriftWriter
+		t.elemBegin()
+		t.i32(1, 0) // DATA_PAGE
+		t.i32(2, int32(len(data)))
+		t.i32(3, int32(len(data)))
+		t.structBegin(5)
+		t.i32(1, int32(m))
+		t.i32(2, 0) // PLAIN
+		t.i32(3, 3) // RLE
+		t.i32(4, 3)
+		t.structEnd()
+		t.structEnd()
+		chunks[i] = parquetChunk{offset: p.off, size: int64(len(t.buf) + len(data)), n: int64(m)}
+		p.put(t.buf)
+		p.put(data)
+	}
+	p.groups = append(p.groups, chunks)
+	p.nRows += int64(n)
+	return nil
+}
+
+// close writes the footer with the schema and the location of each column chunk.
+func (p *parquetWriter) close() error {
+	var t thriftWriter
+	t.elemBegin()
+	t.i32(1, 1)
+	t.listBegin(2, thriftStruct, len(p.cols)+1)
+	t.elemBegin()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.cols)))
+	t.structEnd()
+	for _, c := range p.cols {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		t.i32(3, 0) // REQUIRED
+		t.binary(4, c.name)
+		if c.typ == parquetByteArray {
+			t.i32(6, 0) // UTF8
+		}
+		t.structEnd()
+	}
+	t.i64(3, p.nRows)
+	t.listBegin(4, thriftStruct, len(p.groups))
+	for _, chunks := range p.groups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(chunks))
+		var size int64
+		for i, c := range chunks {
+			size += c.size
+			t.elemBegin()
+			t.i64(2, c.offset)
+			t.structBegin(3)
+			t.i32(1, p.cols[i].typ)
+			t.listBegin(2, thriftI32, 2)
+			t.elem32(0) // PLAIN
+			t.elem32(3) // RLE
+			t.listBegin(3, thriftBinary, 1)
+			t.elemBinary(p.cols[i].name)
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, c.n)
+			t.i64(6, c.size)
+			t.i64(7, c.size)
+			t.i64(9, c.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, size)
+		t.i64(3, chunks[0].n)
+		t.structEnd()
+	}
+	t.binary(6, "goleft indexcov version "+goleft.Version)
+	t.structEnd()
+	p.put(t.buf)
+	p.put(binary.LittleEndian.AppendUint32(nil, uint32(len(t.buf))))
+	p.put([]byte("PAR1"))
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
+
+// thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the subset of the thrift compact protocol needed for parquet metadata.
+type thriftWriter struct {
+	buf []byte
+	// last holds the previous field id for each open struct.
+	last []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf = binary.AppendUvarint(t.buf, v)
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := t.last[len(t.last)-1]
+	t.last[len(t.last)-1] = id
+	if d := id - last; d > 0 && d <= 15 {
+		t.buf = append(t.buf, byte(d)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.zigzag(int64(id))
+	}
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemBinary(s)
+}
+
+// structBegin starts a struct field. It must be closed with structEnd.
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.last = append(t.last, 0)
+}
+
+// structEnd writes the stop byte for the current struct.
+func (t *thriftWriter) structEnd() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) listBegin(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.varint(uint64(n))
+	}
+}
+
+// elemBegin starts a struct that is an element of a list or the outermost struct. It must be
+// closed with structEnd.
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) elem32(v int32) {
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) elemBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// firstDuplicate returns the first name that is found more than once or "" if all are unique.
+func firstDuplicate(names []string) string {
+	seen := make(map[string]bool, len(names))
+	for _, n := range names {
+		if seen[n] {
+			return n
+		}
+		seen[n] = true
+	}
+	return ""
+}
+
+// newBedParquet creates the parquet equivalent of the .bed.gz with a column of depths per sample.
+func newBedParquet(path string, names []string) *parquetWriter {
+	cols := []parquetColumn{{"chrom", parquetByteArray}, {"start", parquetInt64}, {"end", parquetInt64}}
+	for _, n := range names {
+		cols = append(cols, parquetColumn{n, parquetFloat})
+	}
+	p, err := newParquetWriter(path, cols)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// writeBedParquet adds the n tiles in chrom as a row group. Samples with fewer tiles are 0 as in the .bed.gz.
+// pos holds the bins of the depths with --targets.
+func writeBedParquet(p *parquetWriter, chrom string, depths [][]float32, n int, pos []int) {
+	columns := make([]interface{}, 0, len(depths)+3)
+	chroms, starts, ends := make([]string, n), make([]int64, n), make([]int64, n)
+	for i := 0; i < n; i++ {
+		chroms[i], starts[i], ends[i] = chrom, int64(binStart(pos, i)), int64(binStart(pos, i)+cli.BinSize)
+	}
+	columns = append(columns, chroms, starts, ends)
+	for _, d := range depths {
+		if len(d) < n {
+			d = append(append(make([]float32, 0, n), d...), make([]float32, n-len(d))...)
+		}
+		columns = append(columns, d[:n])
+	}
+	if err := p.write(columns...); err != nil {
+		panic(err)
+	}
+}
+
+// newROCParquet creates the parquet equivalent of the .roc file.
+func newROCParquet(path string, names []string) *parquetWriter {
+	cols := []parquetColumn{{"chrom", parquetByteArray}, {"cov", parquetDouble}}
+	for _, n := range names {
+		cols = append(cols, parquetColumn{n, parquetFloat})
+	}
+	p, err := newParquetWriter(path, cols)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func writeROCParquet(p *parquetWriter, chrom string, rocs [][]float32) {
+	chroms, covs := make([]string, slots), make([]float64, slots)
+	for i := range covs {
+		chroms[i], covs[i] = chrom, float64(i)/(slots*slotsMid)
+	}
+	columns := []interface{}{chroms, covs}
+	for _, r := range rocs {
+		columns = append(columns, r)
+	}
+	if err := p.write(columns...); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,181 @@
+package indexcov
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+)
+
+// pcaModelVersion is incremented when the contents of a pcaModel change.
+const pcaModelVersion = 3
+
+// pcaChrom is a chromosome and its number of tiles in the matrix used for PCA.
+type pcaChrom struct {
+	Name string
+	N    int
+	// Mask is the hash of the --mask bins on the chromosome that are not in the matrix.
+	Mask uint64
+	// Targets is the hash of the --targets bins on the chromosome that are the only bins in the matrix.
+	Targets uint64
+}
+
+// pcaModel holds the PCA of a reference cohort so that new samples can be projected into the same space.
+type pcaModel struct {
+	Version int
+	// TileWidth is the --bin-size used for the model.
+	TileWidth int
+	// Stride is the interval between the tiles used.
+	Stride int
+	// Layout gives the chromosomes (without any "chr" prefix) and tiles of the columns in the reference matrix.
+	Layout []pcaChrom
+	// Mask holds the columns used in the model. Columns with no variance in the reference cohort are dropped.
+	Mask []int
+	// Center is the mean of each masked column in the reference.
+	Center []float64
+	// Loadings is row-major with a row per masked column and a column per PC.
+	Loadings []float64
+	// Vars is the proportion of variance explained by each PC.
+	Vars []float64
+	// Samples and Projections are the reference samples and their (row-major) PCs for plotting.
+	Samples     []string
+	Projections []float64
+}
+
+// newPCAModel creates a model from the matrix (samples by tiles) used in pca.
+func newPCAModel(imat *mat.Dense, pc *stat.PC, k int, vars []float64, layout []pcaChrom, samples []string) *pcaModel {
+	r, c := imat.Dims()
+	m := &pcaModel{Version: pcaModelVersion, TileWidth: cli.BinSize, Stride: cli.pcaStride, Vars: vars, Samples: samples}
+	m.Layout = make([]pcaChrom, len(layout))
+	for i, l := range layout {
+		m.Layout[i] = pcaChrom{Name: stripChr(l.Name), N: l.N, Mask: l.Mask, Targets: l.Targets}
+	}
+	var vecs mat.Dense
+	pc.VectorsTo(&vecs)
+	col := make([]float64, r)
+	for j := 0; j < c; j++ {
+		mat.Col(col, j, imat)
+		mean, sd := stat.MeanStdDev(col, nil)
+		if sd == 0 {
+			continue
+		}
+		m.Mask = append(m.Mask, j)
+		m.Center = append(m.Center, mean)
+		for p := 0; p < k; p++ {
+			m.Loadings = append(m.Loadings, vecs.At(j, p))
+		}
+	}
+	m.Projections = m.project(imat).RawMatrix().Data
+	return m
+}
+
+// k returns the number of PCs in the model.
+func (m *pcaModel) k() int {
+	return len(m.Vars)
+}
+
+// project returns the PCs for each row in imat which must have the same columns as the reference.
+func (m *pcaModel) project(imat *mat.Dense) *mat.Dense {
+	r, _ := imat.Dims()
+	x := mat.NewDense(r, len(m.Mask), nil)
+	for i := 0; i < r; i++ {
+		for j, c := range m.Mask {
+			x.Set(i, j, imat.At(i, c)-m.Center[j])
+		}
+	}
+	var proj mat.Dense
+	proj.Mul(x, mat.NewDense(len(m.Mask), m.k(), m.Loadings))
+	return &proj
+}
+
+// align returns a matrix with the same columns as the reference from pca8 which has the given layout.
+// Chromosomes missing from layout are set to the reference mean so they do not affect the projection.
+// It is an error if a chromosome used different bins than the reference.
+func (m *pcaModel) align(pca8 [][]uint8, layout []pcaChrom) (*mat.Dense, error) {
+	offsets := make(map[string]int, len(layout))
+	chroms := make(map[string]pcaChrom, len(layout))
+	off := 0
+	for _, l := range layout {
+		offsets[stripChr(l.Name)] = off
+		chroms[stripChr(l.Name)] = l
+		off += l.N
+	}
+	n := 0
+	for _, l := range m.Layout {
+		n += l.N
+	}
+	imat := mat.NewDense(len(pca8), n, nil)
+	center := make([]float64, n)
+	for j, c := range m.Mask {
+		center[c] = m.Center[j]
+	}
+	off = 0
+	for _, l := range m.Layout {
+		o, ok := offsets[l.Name]
+		if !ok {
+			log.Printf("indexcov: chromosome %s from PCA model not found. using reference mean", l.Name)
+		} else if chroms[l.Name].Mask != l.Mask {
+			return nil, fmt.Errorf("the --mask bins on chromosome %s differ from those used for the PCA model", l.Name)
+		} else if chroms[l.Name].Targets != l.Targets {
+			return nil, fmt.Errorf("the --targets bins on chromosome %s differ from those used for the PCA model", l.Name)
+		}
+		for t := 0; t < l.N; t++ {
+			for i, row := range pca8 {
+				if ok && t < chroms[l.Name].N {
+					imat.Set(i, off+t, float64(row[o+t]))
+				} else {
+					imat.Set(i, off+t, center[off+t])
+				}
+			}
+		}
+		off += l.N
+	}
+	return imat, nil
+}
+
+func (m *pcaModel) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	if err := gob.NewEncoder(gz).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readPCAModel(path string) (*pcaModel, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	m := &pcaModel{}
+	if err := gob.NewDecoder(gz).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version != pcaModelVersion {
+		return nil, fmt.Errorf("unsupported PCA model version %d (expected %d)", m.Version, pcaModelVersion)
+	}
+	if m.TileWidth != cli.BinSize {
+		return nil, fmt.Errorf("PCA model bin size %d does not match --bin-size %d", m.TileWidth, cli.BinSize)
+	}
+	if m.Stride < 1 {
+		return nil, fmt.Errorf("PCA model has no tile stride")
+	}
+	return m, nil
+}
@@ -0,0 +1,61 @@
+package indexcov
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+// pedSample is a row from a user-supplied PED file.
+type pedSample struct {
+	Family   string
+	ID       string
+	Paternal string
+	Maternal string
+	// Sex is 1 for male, 2 for female and 0 if unknown.
+	Sex int
+}
+
+// parseSex returns the PED code for a sex column which may also be given as M/F or male/female.
+func parseSex(s string) int {
+	switch strings.ToLower(s) {
+	case "1", "m", "male":
+		return 1
+	case "2", "f", "female":
+		return 2
+	}
+	return 0
+}
+
+// readPed reads the family, sample, paternal, maternal and sex columns from a PED file keyed by
+// sample ID. Lines starting with '#' are skipped.
+func readPed(path string) map[string]*pedSample {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("indexcov: error opening ped file %s: %s", path, err)
+	}
+	defer f.Close()
+	peds := make(map[string]*pedSample)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		toks := strings.Fields(line)
+		if len(toks) < 5 {
+			log.Fatalf("indexcov: expected at least 5 columns in ped file %s, got: %s", path, line)
+		}
+		peds[toks[1]] = &pedSample{Family: toks[0], ID: toks[1], Paternal: toks[2], Maternal: toks[3], Sex: parseSex(toks[4])}
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatalf("indexcov: error reading ped file %s: %s", path, err)
+	}
+	return peds
+}
+
+// sexDiscordant returns true if the declared sex is known and differs from the inferred sex.
+func (p *pedSample) sexDiscordant(inferred int) bool {
+	return p != nil && p.Sex != 0 && (inferred == 1 || inferred == 2) && p.Sex != inferred
+}
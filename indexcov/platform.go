@@ -0,0 +1,222 @@
+package indexcov
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/go-chartjs/types"
+)
+
+// longReadBytes is the minimum number of compressed bytes per mapped read for a sample without a
+// platform in the header to be grouped as long-read. Short reads are typically well under 500.
+const longReadBytes = 2000
+
+// minPlatformSamples is the minimum number of samples with a platform for it to be normalized separately.
+const minPlatformSamples = 3
+
+// programPlatforms are the platforms implied by the names of programs in the @PG header lines.
+var programPlatforms = map[string]string{"pbmm2": "PACBIO", "ccs": "PACBIO", "pbsv": "PACBIO", "pbindex": "PACBIO",
+	"guppy": "ONT", "dorado": "ONT", "medaka": "ONT"}
+
+// normalizePlatform returns a consistent name for the value of an @RG PL tag.
+func normalizePlatform(pl string) string {
+	pl = strings.ToUpper(strings.TrimSpace(pl))
+	switch pl {
+	case "OXFORD_NANOPORE", "NANOPORE", "ONT":
+		return "ONT"
+	case "PACBIO", "PACBIO_SMRT", "PACBIOHIFI", "HIFI":
+		return "PACBIO"
+	}
+	return pl
+}
+
+// platformClasses maps the platforms from the header to the classes that are normalized together. Bin
+// sizes depend mostly on the read length so platforms with similar reads are in the same class.
+var platformClasses = map[string]string{"ILLUMINA": "short-read", "BGI": "short-read", "DNBSEQ": "short-read", "MGI": "short-read",
+	"ELEMENT": "short-read", "ULTIMA": "short-read", "IONTORRENT": "short-read", "PACBIO": "long-read", "ONT": "long-read"}
+
+// platformFromHeader returns the platform from the @RG PL tags or, failing that, the @PG lines.
+// It is "" if there is no platform in the header.
+func platformFromHeader(h *sam.Header) string {
+	m := make(map[string]bool)
+	for _, rg := range h.RGs() {
+		if pl := normalizePlatform(rg.Get(sam.Tag([2]byte{'P', 'L'}))); pl != "" {
+			m[pl] = true
+		}
+	}
+	if len(m) == 0 {
+		for _, pg := range h.Progs() {
+			for _, name := range []string{pg.Name(), pg.UID()} {
+				if pl, ok := programPlatforms[strings.ToLower(name)]; ok {
+					m[pl] = true
+				}
+			}
+		}
+	}
+	pls := make([]string, 0, len(m))
+	for pl := range m {
+		pls = append(pls, pl)
+	}
+	sort.Strings(pls)
+	return strings.Join(pls, "+")
+}
+
+// averageReadBytes returns the compressed size of all of the bins over the number of mapped reads. It is NaN if the
+// index has no stats or if it is a crai where mapped is in bytes.
+func (x *Index) averageReadBytes() float64 {
+	if x.mapped == 0 || strings.HasSuffix(findIndex(x.path), ".crai") {
+		return math.NaN()
+	}
+	var total int64
+	for _, s := range x.sizes {
+		for _, v := range s {
+			total += v
+		}
+	}
+	// sizes are differences of virtual offsets which have the compressed offset in the upper 48 bits.
+	return float64(total) / 65536 / float64(x.mapped)
+}
+
+// samplePlatform returns "short-read" or "long-read" for the platform from the header if it is known.
+// Otherwise, it is based on the bytes per read or "unknown".
+func samplePlatform(hdrPlatform string, bytesPerRead float64) string {
+	if c, ok := platformClasses[hdrPlatform]; ok {
+		return c
+	}
+	switch {
+	case math.IsNaN(bytesPerRead) || bytesPerRead <= 0:
+		return "unknown"
+	case bytesPerRead >= longReadBytes:
+		return "long-read"
+	}
+	return "short-read"
+}
+
+// platformGroups returns the indexes of the samples in each platform with at least minPlatformSamples
+// samples. It is nil if there are fewer than 2 such platforms as there is nothing to normalize.
+func platformGroups(platforms []string) [][]int {
+	byPlatform := make(map[string][]int)
+	for i, pl := range platforms {
+		if pl != "unknown" {
+			byPlatform[pl] = append(byPlatform[pl], i)
+		}
+	}
+	names := make([]string, 0, len(byPlatform))
+	for pl, idxs := range byPlatform {
+		if len(idxs) >= minPlatformSamples {
+			names = append(names, pl)
+		}
+	}
+	if len(names) < 2 {
+		return nil
+	}
+	sort.Strings(names)
+	groups := make([][]int, len(names))
+	for i, pl := range names {
+		groups[i] = byPlatform[pl]
+	}
+	return groups
+}
+
+// normalizePlatforms scales the samples in each group at each bin by the median of the largest group over
+// the median of the group so that the pattern of bin sizes that is specific to a platform (e.g. from the
+// length of quality strings) is removed and samples can be compared across platforms. Samples in the
+// largest group are not changed.
+func normalizePlatforms(depths [][]float32, groups [][]int) {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	ref := 0
+	for i, g := range groups {
+		if len(g) > len(groups[ref]) {
+			ref = i
+		}
+	}
+	vals := make([]float64, 0, len(depths))
+	groupMedian := func(g []int, j int) float64 {
+		vals = vals[:0]
+		for _, k := range g {
+			if j < len(depths[k]) {
+				vals = append(vals, float64(depths[k][j]))
+			}
+		}
+		return median(vals)
+	}
+	for j := 0; j < longest; j++ {
+		med := groupMedian(groups[ref], j)
+		if med < 0.1 {
+			continue
+		}
+		for i, g := range groups {
+			if i == ref {
+				continue
+			}
+			gmed := groupMedian(g, j)
+			if gmed < 0.1 {
+				continue
+			}
+			scale := float32(med / gmed)
+			for _, k := range g {
+				if j < len(depths[k]) {
+					depths[k][j] *= scale
+				}
+			}
+		}
+	}
+}
+
+// median sorts vals and returns the median. It is 0 if vals is empty.
+func median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sort.Float64s(vals)
+	return vals[len(vals)/2]
+}
+
+// platformSets returns the indexes of the samples after the first nBackground grouped by the platform
+// with the name of each. The platforms are for the last len(platforms) samples. If there is only one
+// platform, all of the samples are in a single set with an empty label.
+func platformSets(n, nBackground int, platforms []string) (labels []string, sets [][]int) {
+	offset := n - len(platforms)
+	byPlatform := make(map[string][]int)
+	for i := nBackground; i < n; i++ {
+		pl := ""
+		if i >= offset {
+			pl = platforms[i-offset]
+		}
+		byPlatform[pl] = append(byPlatform[pl], i)
+	}
+	if len(byPlatform) < 2 {
+		all := make([]int, 0, n-nBackground)
+		for i := nBackground; i < n; i++ {
+			all = append(all, i)
+		}
+		return []string{""}, [][]int{all}
+	}
+	for pl := range byPlatform {
+		labels = append(labels, pl)
+	}
+	sort.Strings(labels)
+	for _, pl := range labels {
+		sets = append(sets, byPlatform[pl])
+	}
+	return labels, sets
+}
+
+// platformColors are used for the sets from platformSets. The first is the color used when there is a
+// single platform.
+var platformColors = []*types.RGBA{{R: 110, G: 250, B: 59, A: 240}, {R: 66, G: 133, B: 244, A: 240},
+	{R: 234, G: 67, B: 53, A: 240}, {R: 251, G: 188, B: 5, A: 240}, {R: 171, G: 71, B: 188, A: 240}}
+
+func platformColor(i int) *types.RGBA {
+	if i < len(platformColors) {
+		return platformColors[i]
+	}
+	return randomColor(i, false)
+}
@@ -16,6 +16,7 @@ import (
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
 
 	chartjs "github.com/brentp/go-chartjs"
 	"github.com/brentp/go-chartjs/types"
@@ -63,7 +64,8 @@ func (v *vs) Sample(nth int) *vs {
 // truncate depth values above this to cnMax
 const cnMax = 2.5
 
-func asValues(vals []float32, multiplier float64) chartjs.Values {
+// asValues converts vals to x, y pairs with x as the index (or the bin in pos if it is not nil) times multiplier.
+func asValues(vals []float32, pos []int, multiplier float64) chartjs.Values {
 
 	// skip until we find non-zero.
 	v := vs{xs: make([]float64, 0, len(vals)), ys: make([]float64, 0, len(vals))}
@@ -73,7 +75,7 @@ func asValues(vals []float32, multiplier float64) chartjs.Values {
 			continue
 		}
 		seenNonZero = true
-		v.xs = append(v.xs, float64(i)*multiplier)
+		v.xs = append(v.xs, float64(binIndex(pos, i))*multiplier)
 		if r > cnMax {
 			r = cnMax
 		}
@@ -107,17 +109,17 @@ func randomColor(s int, check bool) *types.RGBA {
 		A: 240}
 }
 
-func plotDepths(depths [][]float32, samples []string, chrom string, base string, writeHTML bool) error {
+func plotDepths(depths [][]float32, pos []int, samples []string, chrom string, base string, writeHTML bool) (chartjs.Chart, error) {
 	chart := chartjs.Chart{Label: chrom}
 	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "position on " + chrom, Display: chartjs.True}})
 	if err != nil {
-		return err
+		return chart, err
 	}
 	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left,
 		Tick:       &chartjs.Tick{Min: 0, Max: 2.5},
 		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "scaled coverage", Display: chartjs.True}})
 	if err != nil {
-		return err
+		return chart, err
 	}
 
 	w := 0.4
@@ -130,7 +132,7 @@ func plotDepths(depths [][]float32, samples []string, chrom string, base string,
 	datasets := make([]chartjs.Dataset, 0, len(depths))
 
 	for i, depth := range depths {
-		xys := asValues(depth, 16384)
+		xys := asValues(depth, pos, float64(cli.BinSize))
 		//log.Println(chrom, samples[i], len(xys.Xs()))
 		c := randomColor(i, true)
 		dataset := chartjs.Dataset{Data: xys, Label: samples[i], Fill: chartjs.False, PointRadius: 0, BorderWidth: w,
@@ -148,23 +150,22 @@ func plotDepths(depths [][]float32, samples []string, chrom string, base string,
 	if writeHTML {
 		wtr, err := os.Create(fmt.Sprintf("%s-depth-%s.html", base, chrom))
 		if err != nil {
-			return err
+			return chart, err
 		}
 		link := template.HTML(`<a href="index.html">back to index</a>`)
 		if err := chart.SaveHTML(wtr, map[string]interface{}{"width": 850, "height": 550, "customHTML": link}); err != nil {
-			return err
+			return chart, err
 		}
 		if err := wtr.Close(); err != nil {
-			return err
+			return chart, err
 		}
 	}
 	asPng(fmt.Sprintf("%s-depth-%s.png", base, chrom), chart, 4, 3)
 
-	return nil
+	return chart, nil
 }
 
 func plotBins(counts []*counter, samples []string) (chartjs.Chart, string) {
-	c := &types.RGBA{R: 110, G: 250, B: 59, A: 240}
 	chart := chartjs.Chart{}
 	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16,
 		LabelString: "proportion of bins with depth < 0.15",
@@ -182,63 +183,93 @@ func plotBins(counts []*counter, samples []string) (chartjs.Chart, string) {
 	if err != nil {
 		panic(err)
 	}
-	cxys := &vs{xs: make([]float64, 0, len(counts)), ys: make([]float64, 0, len(counts))}
-	bxys := &vs{xs: make([]float64, 0, len(counts)), ys: make([]float64, 0, len(counts))}
 	min, max := float64(1000000), float64(0)
-
-	for i, c := range counts {
-		xys := cxys
-		if i < backgroundN {
-			xys = bxys
-		}
-		if c == nil {
-			continue
+	// names has the sample names for each dataset for the tooltips.
+	var names [][]string
+	binsSet := func(idxs []int) (*vs, []string) {
+		xys := &vs{xs: make([]float64, 0, len(idxs)), ys: make([]float64, 0, len(idxs))}
+		nms := make([]string, 0, len(idxs))
+		for _, i := range idxs {
+			c := counts[i]
+			if c == nil {
+				continue
+			}
+			tot := float64(c.in + c.out)
+			val := float64(c.low) / math.Max(tot, 1)
+			xys.xs = append(xys.xs, val)
+			if val > max {
+				max = val
+			}
+			if val < min {
+				min = val
+			}
+			xys.ys = append(xys.ys, float64(c.out)/tot)
+			nms = append(nms, samples[i])
 		}
-		tot := float64(c.in + c.out)
-		val := float64(c.low) / math.Max(tot, 1)
-		xys.xs = append(xys.xs, val)
-		if val > max {
-			max = val
+		return xys, nms
+	}
+	var bxys *vs
+	if backgroundN > 0 {
+		bg := make([]int, 0, backgroundN)
+		for i := 0; i < backgroundN && i < len(counts); i++ {
+			bg = append(bg, i)
 		}
-		if val < min {
-			min = val
+		var nms []string
+		bxys, nms = binsSet(bg)
+		for i := range nms {
+			nms[i] = "background"
 		}
-		xys.ys = append(xys.ys, float64(c.out)/tot)
+		names = append(names, nms)
+	}
+	labels, sets := platformSets(len(counts), backgroundN, cli.platforms)
+	xyss := make([]*vs, len(sets))
+	for i, set := range sets {
+		var nms []string
+		xyss[i], nms = binsSet(set)
+		names = append(names, nms)
 	}
 	rng := max - min
 	chart.Options.Scales.XAxes[0].Tick.Min = min - 0.1*rng
 	chart.Options.Scales.XAxes[0].Tick.Max = max + 0.1*rng
 	if backgroundN > 0 {
-		plotBinsSet(&chart, bxys, &types.RGBA{R: 180, G: 180, B: 180, A: 240}, xa, ya)
+		plotBinsSet(&chart, bxys, "background", &types.RGBA{R: 180, G: 180, B: 180, A: 240}, xa, ya)
+	}
+	for i, xys := range xyss {
+		plotBinsSet(&chart, xys, orSamples(labels[i]), platformColor(i), xa, ya)
 	}
-	plotBinsSet(&chart, cxys, c, xa, ya)
 
 	chart.Options.Responsive = chartjs.False
 	chart.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
 	chart.Options.Legend = &chartjs.Legend{Display: chartjs.False}
-	sjson, err := json.Marshal(samples[backgroundN:])
+	if len(sets) > 1 {
+		chart.Options.Legend = &chartjs.Legend{Display: chartjs.True}
+	}
+	sjson, err := json.Marshal(names)
 	if err != nil {
 		panic(err)
 	}
 	jsfunc := fmt.Sprintf(`
     bin_chart.options.tooltips.callbacks.title = function(tts, data) {
         var names = %s
-		var has_backgrounds = %v
         var out = []
         tts.forEach(function(ti) {
-			if(has_backgrounds == (ti.datasetIndex == 1)) {
-                out.push(names[ti.index])
-	 	    } else {
-				out.push("background")
-			}
+            out.push(names[ti.datasetIndex][ti.index])
         })
         return out.join(",")
-    }`, sjson, backgroundN > 0)
+    }`, sjson)
 	return chart, jsfunc
 }
 
-func plotBinsSet(chart *chartjs.Chart, xys *vs, c *types.RGBA, xa string, ya string) {
-	dataset := chartjs.Dataset{Data: xys, Label: "samples", Fill: chartjs.False, PointHoverRadius: 6,
+// orSamples returns "samples" for the label of a dataset if label is empty.
+func orSamples(label string) string {
+	if label == "" {
+		return "samples"
+	}
+	return label
+}
+
+func plotBinsSet(chart *chartjs.Chart, xys *vs, label string, c *types.RGBA, xa string, ya string) {
+	dataset := chartjs.Dataset{Data: xys, Label: label, Fill: chartjs.False, PointHoverRadius: 6,
 		PointRadius: 4, BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150},
 		PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
 	dataset.XFloatFormat = "%.5f"
@@ -248,10 +279,23 @@ func plotBinsSet(chart *chartjs.Chart, xys *vs, c *types.RGBA, xa string, ya str
 	chart.AddDataset(dataset)
 }
 
-func plotPCA(imat *mat.Dense, samples []string, vars []float64) ([]chartjs.Chart, string) {
+// plotPCA plots PC1 against PC2 and PC3. The first nBackground samples are plotted in gray and the
+// others are colored by platform if there is more than one.
+func plotPCA(imat *mat.Dense, samples []string, vars []float64, nBackground int) ([]chartjs.Chart, string) {
 
 	var charts []chartjs.Chart
-	c := &types.RGBA{R: 110, G: 250, B: 59, A: 240}
+	labels, sets := platformSets(len(samples), nBackground, cli.platforms)
+	bg := make([]int, nBackground)
+	for i := range bg {
+		bg[i] = i
+	}
+	pick := func(col []float64, idxs []int) []float64 {
+		vals := make([]float64, len(idxs))
+		for i, j := range idxs {
+			vals[i] = col[j]
+		}
+		return vals
+	}
 
 	for _, pc := range []int{2, 3} {
 
@@ -270,29 +314,52 @@ func plotPCA(imat *mat.Dense, samples []string, vars []float64) ([]chartjs.Chart
 		if err != nil {
 			panic(err)
 		}
-		if backgroundN > 0 {
+		xcol, ycol := mat.Col(nil, 0, imat), mat.Col(nil, pc-1, imat)
+		if nBackground > 0 {
 			c := &types.RGBA{R: 180, G: 180, B: 180, A: 240}
-			xys := &vs{xs: mat.Col(nil, 0, imat)[:backgroundN], ys: mat.Col(nil, pc-1, imat)[:backgroundN]}
-			dataset := chartjs.Dataset{Data: xys, Label: "samples", Fill: chartjs.False, PointHoverRadius: 6,
+			xys := &vs{xs: pick(xcol, bg), ys: pick(ycol, bg)}
+			dataset := chartjs.Dataset{Data: xys, Label: "background", Fill: chartjs.False, PointHoverRadius: 6,
+				PointRadius: 4,
+				BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
+			dataset.XAxisID = xa
+			dataset.YAxisID = ya
+			c1.AddDataset(dataset)
+		}
+		for i, set := range sets {
+			c := platformColor(i)
+			xys := &vs{xs: pick(xcol, set), ys: pick(ycol, set)}
+			dataset := chartjs.Dataset{Data: xys, Label: orSamples(labels[i]), Fill: chartjs.False, PointHoverRadius: 6,
 				PointRadius: 4,
 				BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
 			dataset.XAxisID = xa
 			dataset.YAxisID = ya
 			c1.AddDataset(dataset)
 		}
-		xys := &vs{xs: mat.Col(nil, 0, imat)[backgroundN:], ys: mat.Col(nil, pc-1, imat)[backgroundN:]}
-		dataset := chartjs.Dataset{Data: xys, Label: "samples", Fill: chartjs.False, PointHoverRadius: 6,
-			PointRadius: 4,
-			BorderWidth: 0, BorderColor: &types.RGBA{R: 150, G: 150, B: 150, A: 150}, PointBackgroundColor: c, BackgroundColor: c, ShowLine: chartjs.False, PointHitRadius: 6}
-		dataset.XAxisID = xa
-		dataset.YAxisID = ya
-		c1.AddDataset(dataset)
 		c1.Options.Responsive = chartjs.False
 		c1.Options.Legend = &chartjs.Legend{Display: chartjs.False}
+		if len(sets) > 1 {
+			c1.Options.Legend = &chartjs.Legend{Display: chartjs.True}
+		}
 		c1.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
 		charts = append(charts, c1)
 	}
-	sjson, err := json.Marshal(samples[backgroundN:])
+	// names has the sample names for each dataset for the tooltips.
+	var names [][]string
+	if nBackground > 0 {
+		bgNames := make([]string, nBackground)
+		for i := range bgNames {
+			bgNames[i] = "background"
+		}
+		names = append(names, bgNames)
+	}
+	for _, set := range sets {
+		nms := make([]string, len(set))
+		for i, j := range set {
+			nms[i] = samples[j]
+		}
+		names = append(names, nms)
+	}
+	sjson, err := json.Marshal(names)
 	if err != nil {
 		panic(err)
 	}
@@ -300,17 +367,12 @@ func plotPCA(imat *mat.Dense, samples []string, vars []float64) ([]chartjs.Chart
 	chart.options.hover.mode = 'index';
 	chart.options.tooltips.callbacks.title = function(tts, data) {
         var names = %s
-        var has_backgrounds = %v
         var out = []
         tts.forEach(function(ti) {
-            if(has_backgrounds == (ti.datasetIndex == 1)) {
-                out.push(names[ti.index])
-            } else {
-                out.push("background")
-            }
+            out.push(names[ti.datasetIndex][ti.index])
         })
         return out.join(",")
-    }`, sjson, backgroundN > 0)
+    }`, sjson)
 
 	return charts, jsfunc
 }
@@ -333,7 +395,7 @@ func plotROCs(rocs [][]float32, samples []string, chrom string) (chartjs.Chart,
 	datasets := make([]chartjs.Dataset, 0, len(rocs))
 
 	for i, roc := range rocs {
-		xys := asValues(roc, 1/float64(slots)*1/slotsMid)
+		xys := asValues(roc, nil, 1/float64(slots)*1/slotsMid)
 		c := randomColor(i, true)
 		label := samples[i]
 		if i < backgroundN {
@@ -352,19 +414,20 @@ func plotROCs(rocs [][]float32, samples []string, chrom string) (chartjs.Chart,
 	return chart, nil
 }
 
-func plotMapped(mapped []uint64, unmapped []uint64, samples []string) (*chartjs.Chart, string, error) {
+// plotMapped plots mapped against unmapped for each sample. units is "reads" for bam indexes and "bytes" for crais.
+func plotMapped(mapped []uint64, unmapped []uint64, samples []string, units string) (*chartjs.Chart, string, error) {
 	if len(mapped) != len(samples) {
 		return nil, "", fmt.Errorf("plottMapped: unequal numbers in samples and mapped: %d vs %d", len(mapped), len(samples))
 	}
 	chart := chartjs.Chart{}
 	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom,
-		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "log(mapped reads)",
+		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "log(mapped " + units + ")",
 			Display: chartjs.True}, Tick: &chartjs.Tick{Min: 0}})
 	if err != nil {
 		return nil, "", err
 	}
 	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left,
-		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "log(unmapped reads)",
+		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "log(unmapped " + units + ")",
 			Display: chartjs.True}, Tick: &chartjs.Tick{Min: 0}})
 	if err != nil {
 		return nil, "", err
@@ -409,7 +472,9 @@ func plotMapped(mapped []uint64, unmapped []uint64, samples []string) (*chartjs.
 	return &chart, jsfunc, nil
 }
 
-func plotSex(sexes map[string][]float64, chroms []string, samples []string) (*chartjs.Chart, string, error) {
+// plotSex plots the copy-number of the first 2 sex chromosomes colored by inferred sex. If discordant is not nil,
+// samples with a declared sex that differs from the inferred sex are circled.
+func plotSex(sexes map[string][]float64, chroms []string, samples []string, discordant []bool) (*chartjs.Chart, string, error) {
 	chart := chartjs.Chart{Label: "sex"}
 	tmp := sexes["_inferred"]
 	inferred := make([]int, len(tmp))
@@ -454,6 +519,27 @@ func plotSex(sexes map[string][]float64, chroms []string, samples []string) (*ch
 		dataset.YAxisID = ya
 		chart.AddDataset(dataset)
 	}
+	if discordant != nil {
+		names := make([]string, 0)
+		vals := &vs{}
+		for i, d := range discordant {
+			if d {
+				names = append(names, samples[i])
+				vals.xs = append(vals.xs, sexes[chroms[0]][i])
+				vals.ys = append(vals.ys, sexes[chroms[1]][i])
+			}
+		}
+		if len(names) > 0 {
+			jssamples = append(jssamples, names)
+			red := &types.RGBA{R: 220, G: 20, B: 20, A: 255}
+			dataset := chartjs.Dataset{Data: vals, Label: "Declared sex discordant", Fill: chartjs.False, PointRadius: 11, BorderWidth: 0,
+				BorderColor: red, PointBorderColor: red, PointBorderWidth: 2.5, BackgroundColor: &types.RGBA{}, PointBackgroundColor: &types.RGBA{},
+				ShowLine: chartjs.False, PointHitRadius: 6}
+			dataset.XAxisID = xa
+			dataset.YAxisID = ya
+			chart.AddDataset(dataset)
+		}
+	}
 	sjson, err := json.Marshal(jssamples)
 	if err != nil {
 		panic(err)
@@ -473,12 +559,63 @@ func plotSex(sexes map[string][]float64, chroms []string, samples []string) (*ch
 	return &chart, jsfunc, nil
 }
 
+// staticFormats are the values allowed for --format.
+var staticFormats = map[string]bool{"png": true, "svg": true, "pdf": true}
+
+// asPng saves the chart as a png at path for use in the HTML. It is also saved in --format if that is set.
 func asPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
+	if err := savePlot(chartPlot(chart), path, vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, true); err != nil {
+		panic(err)
+	}
+}
+
+// asStatic saves a chart that is otherwise only in the HTML in --format. path ends in .png which is
+// replaced by the format. Nothing is written if --format is not set.
+func asStatic(path string, chart chartjs.Chart, wInches float64, hInches float64) {
+	if cli.Format == "" {
+		return
+	}
+	if err := savePlot(chartPlot(chart), path, vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, false); err != nil {
+		panic(err)
+	}
+}
+
+// savePlot saves p as a png at path if png is true and in --format (with the extension of path replaced)
+// if that is set. All of the static plots are saved through here.
+func savePlot(p *plot.Plot, path string, w vg.Length, h vg.Length, png bool) error {
+	if png {
+		if err := p.Save(w, h, path); err != nil {
+			return err
+		}
+	}
+	if cli.Format == "" || (png && cli.Format == "png") {
+		return nil
+	}
+	return p.Save(w, h, formatPath(path))
+}
+
+// formatPath returns path with the .png extension replaced by --format.
+func formatPath(path string) string {
+	return strings.TrimSuffix(path, ".png") + "." + cli.Format
+}
+
+// chartPlot draws the datasets of a chart with gonum/plot. Datasets without lines (e.g. PCA, bins, sex)
+// are drawn as points and get a legend if there is more than one.
+func chartPlot(chart chartjs.Chart) *plot.Plot {
 	p := plot.New()
 	p.X.Label.Text = chart.Options.Scales.XAxes[0].ScaleLabel.LabelString
 	p.Y.Label.Text = chart.Options.Scales.YAxes[0].ScaleLabel.LabelString
+	var legend []*plotter.Scatter
+	var labels []string
 	for i := range chart.Data.Datasets {
 		ds := chart.Data.Datasets[len(chart.Data.Datasets)-i-1]
+		if ds.ShowLine != nil && !*ds.ShowLine {
+			s := scatterPlot(ds)
+			p.Add(s)
+			legend = append(legend, s)
+			labels = append(labels, ds.Label)
+			continue
+		}
 		data := ds.Data
 		// gonum plotting is a significant portion of the runtime so we sample datasets.
 		if data.(*vs).Len() > 2000 {
@@ -513,27 +650,52 @@ func asPng(path string, chart chartjs.Chart, wInches float64, hInches float64) {
 		l.Color = c
 		p.Add(l)
 	}
-	data := chart.Data.Datasets[0].Data.(*vs)
-	xs := data.Xs()
+	if len(legend) > 1 && (chart.Options.Legend == nil || chart.Options.Legend.Display == nil || *chart.Options.Legend.Display) {
+		p.Legend.Top = true
+		for i := len(legend) - 1; i >= 0; i-- {
+			p.Legend.Add(labels[i], legend[i])
+		}
+	}
 	// check if we are in a depth plot
-	if len(xs) > 0 && xs[len(xs)-1] > 3 {
+	if strings.HasPrefix(p.X.Label.Text, "position on ") {
 		p.Y.Tick.Marker = ydticks{}
 		p.X.Tick.Marker = xdticks{}
 	}
+	return p
+}
 
-	if err := p.Save(vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, path); err != nil {
+// scatterPlot draws the points of ds with the size and colors used by chartjs. Points with a
+// transparent background are drawn as rings in the border color.
+func scatterPlot(ds chartjs.Dataset) *plotter.Scatter {
+	data := ds.Data.(*vs)
+	pts := &vs{xs: make([]float64, 0, data.Len()), ys: make([]float64, 0, data.Len())}
+	for i, x := range data.xs {
+		if !math.IsNaN(x) && !math.IsNaN(data.ys[i]) {
+			pts.xs = append(pts.xs, x)
+			pts.ys = append(pts.ys, data.ys[i])
+		}
+	}
+	s, err := plotter.NewScatter(pts)
+	if err != nil {
 		panic(err)
 	}
-	// Set INDEXCOV_FMT env variable to also get .eps and .svg
-	if fmt := os.Getenv("INDEXCOV_FMT"); fmt != "" {
-		if fmt != "svg" {
-			fmt = "eps"
-		}
-		l := len(path) - 3
-		if err := p.Save(vg.Length(wInches)*vg.Inch, vg.Length(hInches)*vg.Inch, path[:l]+fmt); err != nil {
-			panic(err)
-		}
+	// chartjs sizes are in pixels at 96 per inch.
+	s.GlyphStyle.Radius = vg.Points(0.75 * math.Max(ds.PointRadius, 1))
+	s.GlyphStyle.Shape = draw.CircleGlyph{}
+	c := ds.PointBackgroundColor
+	if c == nil || c.A == 0 {
+		s.GlyphStyle.Shape = draw.RingGlyph{}
+		c = ds.PointBorderColor
+	}
+	if c == nil {
+		c = ds.BorderColor
+	}
+	if c != nil {
+		rgba := color.RGBA(*c)
+		rgba.A = 255
+		s.GlyphStyle.Color = rgba
 	}
+	return s
 }
 
 type ydticks struct{}
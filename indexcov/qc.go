@@ -0,0 +1,164 @@
+package indexcov
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"gonum.org/v1/gonum/mat"
+)
+
+// minQCSamples is the fewest samples for which outliers are reported.
+const minQCSamples = 5
+
+// qcMetric is a per-sample value where outliers in one direction indicate a bad sample.
+type qcMetric struct {
+	name string
+	vals []float64
+	// high is true if high values are bad and false if low values are bad.
+	high bool
+}
+
+// qcSample is the QC verdict for a single sample.
+type qcSample struct {
+	Sample      string             `json:"sample"`
+	Pass        bool               `json:"qc_pass"`
+	Reasons     []string           `json:"qc_reasons"`
+	Z           map[string]float64 `json:"z"`
+	Mahalanobis float64            `json:"mahalanobis"`
+}
+
+// qcSummary is written as JSON for use in pipelines.
+type qcSummary struct {
+	Version        string     `json:"version"`
+	MaxZ           float64    `json:"max_z"`
+	MaxMahalanobis float64    `json:"max_mahalanobis"`
+	NSamples       int        `json:"n_samples"`
+	NFail          int        `json:"n_fail"`
+	Samples        []qcSample `json:"samples"`
+}
+
+// medianMAD returns the median and the scaled median absolute deviation of vals.
+// If the MAD is 0, the scaled mean absolute deviation is used instead.
+func medianMAD(vals []float64) (float64, float64) {
+	tmp := append([]float64{}, vals...)
+	sort.Float64s(tmp)
+	med := tmp[len(tmp)/2]
+	if len(tmp)%2 == 0 {
+		med = (tmp[len(tmp)/2-1] + tmp[len(tmp)/2]) / 2
+	}
+	var mean float64
+	for i, v := range vals {
+		tmp[i] = math.Abs(v - med)
+		mean += tmp[i]
+	}
+	sort.Float64s(tmp)
+	if mad := 1.4826 * tmp[len(tmp)/2]; mad > 0 {
+		return med, mad
+	}
+	return med, 1.2533 * mean / float64(len(tmp))
+}
+
+// qcSamples scores each sample relative to the cohort. A sample fails if any metric has a robust
+// (median/MAD) z-score beyond maxZ in the bad direction or if its robust Mahalanobis distance
+// from the center of the cohort in PC space is more than maxD.
+func qcSamples(samples []string, counts []*counter, slopes []float32, pcs *mat.Dense, maxZ float64, maxD float64) []qcSample {
+	n := len(samples)
+	metrics := []qcMetric{
+		{name: "bins.out", high: true}, {name: "bins.lo", high: true},
+		{name: "bins.hi", high: true}, {name: "p.out", high: true}, {name: "slope", high: false},
+	}
+	for i := range metrics {
+		metrics[i].vals = make([]float64, n)
+	}
+	for i, c := range counts {
+		if c == nil {
+			continue
+		}
+		metrics[0].vals[i] = float64(c.out)
+		metrics[1].vals[i] = float64(c.low)
+		metrics[2].vals[i] = float64(c.hi)
+		metrics[3].vals[i] = float64(c.out) / math.Max(1, float64(c.in))
+		metrics[4].vals[i] = float64(slopes[i])
+	}
+
+	res := make([]qcSample, n)
+	for i, s := range samples {
+		res[i] = qcSample{Sample: s, Pass: true, Reasons: []string{}, Z: make(map[string]float64, len(metrics))}
+	}
+	if n < minQCSamples {
+		return res
+	}
+	for _, m := range metrics {
+		med, mad := medianMAD(m.vals)
+		if mad == 0 {
+			continue
+		}
+		for i, v := range m.vals {
+			z := (v - med) / mad
+			res[i].Z[m.name] = z
+			if (m.high && z > maxZ) || (!m.high && z < -maxZ) {
+				res[i].Pass = false
+				res[i].Reasons = append(res[i].Reasons, fmt.Sprintf("%s:z=%.1f", m.name, z))
+			}
+		}
+	}
+
+	if pcs != nil {
+		// PCs are uncorrelated so the distance uses a robust scale for each PC.
+		_, c := pcs.Dims()
+		for j := 0; j < c; j++ {
+			col := mat.Col(nil, j, pcs)
+			med, mad := medianMAD(col)
+			if mad == 0 {
+				continue
+			}
+			for i, v := range col {
+				res[i].Mahalanobis += math.Pow((v-med)/mad, 2)
+			}
+		}
+		for i := range res {
+			res[i].Mahalanobis = math.Sqrt(res[i].Mahalanobis)
+			if res[i].Mahalanobis > maxD {
+				res[i].Pass = false
+				res[i].Reasons = append(res[i].Reasons, fmt.Sprintf("PCA:distance=%.1f", res[i].Mahalanobis))
+			}
+		}
+	}
+	return res
+}
+
+// qcColumns returns the values for the qc_pass and qc_reasons columns of the .ped.
+func qcColumns(q qcSample, nSamples int) []string {
+	if nSamples < minQCSamples {
+		return []string{"NA", "NA"}
+	}
+	if q.Pass {
+		return []string{"true", "NA"}
+	}
+	return []string{"false", strings.Join(q.Reasons, ",")}
+}
+
+func writeQCJSON(path string, qc []qcSample, maxZ float64, maxD float64) error {
+	s := qcSummary{Version: goleft.Version, MaxZ: maxZ, MaxMahalanobis: maxD, NSamples: len(qc), Samples: qc}
+	for _, q := range qc {
+		if !q.Pass {
+			s.NFail++
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,198 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// duplicateCorrelation is the minimum correlation of coverage profiles for a pair of samples to be flagged
+// as duplicates. Profiles of different libraries are nearly uncorrelated once the cohort median is removed.
+const duplicateCorrelation = 0.8
+
+// profileBlock is the number of tiles accumulated before they are added to the cross-products.
+const profileBlock = 1024
+
+// maxProfileSamples is the largest cohort for which coverage profiles are compared. The cross-products
+// use 8*n*n bytes so this keeps them under 200MB.
+const maxProfileSamples = 5000
+
+// profileCorr accumulates the pairwise correlation of each sample's deviation from the cohort median
+// at every tile on the autosomes. Tiles in gaps or in CNVs shared by several samples are masked so that
+// only library-specific noise, which is shared by duplicates, remains.
+type profileCorr struct {
+	n     int
+	tiles int
+	sums  []float64
+	cross *mat.SymDense
+	// sd is the standard deviation of each profile. It is set by finish.
+	sd []float64
+	// block holds the deviations (samples by tiles) that have not yet been added to cross.
+	block []float64
+	nb    int
+}
+
+// newProfileCorr returns a profileCorr for n samples. Profiles are not compared if n is more than
+// maxProfileSamples.
+func newProfileCorr(n int) *profileCorr {
+	if n > maxProfileSamples {
+		log.Printf("indexcov: not comparing coverage profiles for more than %d samples", maxProfileSamples)
+		return &profileCorr{}
+	}
+	return &profileCorr{n: n, sums: make([]float64, n), cross: mat.NewSymDense(n, nil), block: make([]float64, n*profileBlock)}
+}
+
+// add the tiles for a chromosome. Every stride'th tile is used.
+func (p *profileCorr) add(depths [][]float32, stride int) {
+	if p.n < 3 {
+		return
+	}
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	// more than this many samples with a large deviation at a tile indicates a common CNV.
+	maxOut := p.n / 100
+	if maxOut < 1 {
+		maxOut = 1
+	}
+	vals := make([]float64, p.n)
+	tmp := make([]float64, p.n)
+TILES:
+	for t := 0; t < longest; t += stride {
+		for k, d := range depths {
+			if t >= len(d) {
+				continue TILES
+			}
+			vals[k] = float64(d[t])
+		}
+		copy(tmp, vals)
+		sort.Float64s(tmp)
+		med := tmp[p.n/2]
+		if med < 0.5 || med > 1.5 {
+			continue
+		}
+		nOut := 0
+		for k, v := range vals {
+			vals[k] = v - med
+			if math.Abs(vals[k]) > 0.5 {
+				nOut++
+				vals[k] = math.Copysign(0.5, vals[k])
+			}
+		}
+		if nOut > maxOut {
+			continue
+		}
+		for k, v := range vals {
+			p.block[k*profileBlock+p.nb] = v
+			p.sums[k] += v
+		}
+		p.nb++
+		p.tiles++
+		if p.nb == profileBlock {
+			p.flush()
+		}
+	}
+}
+
+func (p *profileCorr) flush() {
+	if p.nb == 0 {
+		return
+	}
+	x := mat.NewDense(p.n, profileBlock, p.block).Slice(0, p.n, 0, p.nb)
+	p.cross.SymRankK(p.cross, 1, x)
+	p.nb = 0
+}
+
+// finish adds the remaining tiles and sets the standard deviation of each profile. It returns false
+// if there are too few tiles to compare the profiles.
+func (p *profileCorr) finish() bool {
+	p.flush()
+	if p.tiles < 2 {
+		return false
+	}
+	n := float64(p.tiles)
+	p.sd = make([]float64, p.n)
+	for i := range p.sd {
+		p.sd[i] = math.Sqrt(p.cross.At(i, i)/n - p.sums[i]/n*p.sums[i]/n)
+	}
+	return true
+}
+
+// correlation returns the correlation of the profiles of samples i and j. finish must be called first.
+func (p *profileCorr) correlation(i, j int) float64 {
+	n := float64(p.tiles)
+	return (p.cross.At(i, j)/n - p.sums[i]/n*p.sums[j]/n) / (p.sd[i] * p.sd[j])
+}
+
+// samplePair is a pair of samples with a suspiciously similar coverage profile.
+type samplePair struct {
+	A, B        string
+	Correlation float64
+	Flags       string
+}
+
+// sexCheck is a sample with a declared sex that differs from the inferred sex.
+type sexCheck struct {
+	Sample   string
+	Declared int
+	Inferred int
+}
+
+// write writes the correlation for the pairs of samples that are flagged as duplicates or for every pair
+// with --all-pairs. Duplicates that differ in inferred or declared sex or that are declared in different
+// families are also flagged. It returns the duplicate pairs and the samples with a declared sex that
+// differs from the inferred sex.
+func (p *profileCorr) write(path string, samples []string, inferred []float64, peds map[string]*pedSample) ([]samplePair, []sexCheck, error) {
+	var discordant []sexCheck
+	for i, s := range samples {
+		if ped := peds[s]; ped.sexDiscordant(int(inferred[i])) {
+			discordant = append(discordant, sexCheck{Sample: s, Declared: ped.Sex, Inferred: int(inferred[i])})
+		}
+	}
+	if !p.finish() {
+		return nil, discordant, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "#sample_a\tsample_b\tcorrelation\tn_tiles\tflags")
+	var dups []samplePair
+	for i := 0; i < len(samples); i++ {
+		for j := i + 1; j < len(samples); j++ {
+			r := p.correlation(i, j)
+			if r < duplicateCorrelation && !cli.AllPairs {
+				continue
+			}
+			var flags []string
+			if r >= duplicateCorrelation {
+				flags = append(flags, "duplicate")
+				pa, pb := peds[samples[i]], peds[samples[j]]
+				if int(inferred[i]) != int(inferred[j]) || (pa != nil && pb != nil && pa.Sex != 0 && pb.Sex != 0 && pa.Sex != pb.Sex) {
+					flags = append(flags, "sex_mismatch")
+				}
+				if pa != nil && pb != nil && pa.Family != pb.Family {
+					flags = append(flags, "family_mismatch")
+				}
+				dups = append(dups, samplePair{A: samples[i], B: samples[j], Correlation: r, Flags: strings.Join(flags, ",")})
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.3f\t%d\t%s\n", samples[i], samples[j], r, p.tiles, orNA(flags))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].Correlation > dups[j].Correlation })
+	return dups, discordant, f.Close()
+}
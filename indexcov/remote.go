@@ -0,0 +1,355 @@
+package indexcov
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brentp/xopen"
+)
+
+// remoteRetries is the number of attempts for each request to a remote index.
+const remoteRetries = 4
+
+// remoteBackoff is the wait before the first retry. It doubles for each retry.
+var remoteBackoff = 500 * time.Millisecond
+
+var remoteClient = &http.Client{Timeout: 5 * time.Minute}
+
+// isURL returns true for paths that are read over HTTP(S) or from S3.
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") || strings.HasPrefix(p, "s3://")
+}
+
+// openPath opens a local file or URL. Remote indexes are read fully (with retries) so that a
+// broken connection is retried; other files, such as bams for the header, are streamed.
+func openPath(p string) (io.ReadCloser, error) {
+	if !isURL(p) {
+		return os.Open(p)
+	}
+	if strings.HasSuffix(p, ".bam") || strings.HasSuffix(p, ".cram") {
+		resp, err := remoteRequest("GET", p)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	var lastErr error
+	for i := 0; i < remoteRetries; i++ {
+		resp, err := remoteRequest("GET", p)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("indexcov: error reading %s: %s", p, lastErr)
+}
+
+// existsPath is xopen.Exists for local files and URLs.
+func existsPath(p string) bool {
+	if !isURL(p) {
+		return xopen.Exists(p)
+	}
+	_, _, err := statPath(p)
+	return err == nil
+}
+
+// statPath returns the size and modification time of a local file or URL.
+func statPath(p string) (int64, int64, error) {
+	if !isURL(p) {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		return fi.Size(), fi.ModTime().UnixNano(), nil
+	}
+	resp, err := remoteRequest("HEAD", p)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp.Body.Close()
+	var mod int64
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		mod = t.UnixNano()
+	}
+	return resp.ContentLength, mod, nil
+}
+
+// errNotFound is returned for a 404 which is not retried.
+type errNotFound string
+
+func (e errNotFound) Error() string { return string(e) + ": not found" }
+
+// remoteRequest makes the request, retrying with exponential backoff on errors and on
+// 429 and 5XX responses. Any other status besides 200 is an error.
+func remoteRequest(method string, p string) (*http.Response, error) {
+	var lastErr error
+	wait := remoteBackoff
+	for i := 0; i < remoteRetries; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		req, err := newRemoteRequest(method, p)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := remoteClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errNotFound(p)
+		}
+		lastErr = fmt.Errorf("%s %s: %s", method, p, resp.Status)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, lastErr
+		}
+	}
+	return nil, fmt.Errorf("indexcov: giving up after %d attempts: %s", remoteRetries, lastErr)
+}
+
+// newRemoteRequest creates the request for an http(s) or s3 URL.
+func newRemoteRequest(method string, p string) (*http.Request, error) {
+	if !strings.HasPrefix(p, "s3://") {
+		return http.NewRequest(method, p, nil)
+	}
+	bucket, key := splitS3(p)
+	return newS3Request(method, bucket, key, nil)
+}
+
+// splitS3 returns the bucket and key from an s3:// URL.
+func splitS3(p string) (string, string) {
+	p = strings.TrimPrefix(p, "s3://")
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// s3Endpoint returns the endpoint and region for S3 requests. AWS_ENDPOINT_URL (or S3_ENDPOINT)
+// can be set for S3-compatible stores like MinIO.
+func s3Endpoint() (string, string) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = os.Getenv("S3_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return strings.TrimRight(endpoint, "/"), region
+}
+
+// newS3Request creates a path-style request for the key in bucket. If credentials are set in
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (and optionally AWS_SESSION_TOKEN), it is signed.
+func newS3Request(method string, bucket string, key string, query url.Values) (*http.Request, error) {
+	endpoint, region := s3Endpoint()
+	u, err := url.Parse(endpoint + "/" + bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	// set the encoding explicitly so that the request matches what is signed.
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+			req.Header.Set("X-Amz-Security-Token", token)
+		}
+		signV4(req, id, secret, region, time.Now().UTC())
+	}
+	return req, nil
+}
+
+// emptySHA256 is the hash of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds an AWS signature version 4 Authorization header for S3 to a request without a body.
+// The host, range and x-amz-* headers are signed.
+func signV4(req *http.Request, id string, secret string, region string, t time.Time) {
+	date := t.Format("20060102")
+	stamp := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, s3EscapePath(req.URL.Path), canonicalQuery(req.URL.Query()),
+		canonHeaders.String(), signed, emptySHA256}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	for _, s := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", id, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// s3Escape URI-encodes s as required for AWS signatures.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, s := range parts {
+		parts[i] = s3Escape(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3List is the subset of a ListObjectsV2 response that is used.
+type s3List struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// globS3 returns the s3:// URLs that match the glob pattern in p. Only the key is a pattern.
+func globS3(p string) ([]string, error) {
+	bucket, pattern := splitS3(p)
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?["); i != -1 {
+		prefix = pattern[:i]
+	}
+	var result []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var list s3List
+		err := withRetries(func() error {
+			req, err := newS3Request("GET", bucket, "", q)
+			if err != nil {
+				return err
+			}
+			resp, err := remoteClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("listing s3://%s/%s: %s", bucket, prefix, resp.Status)
+			}
+			list = s3List{}
+			return xml.NewDecoder(resp.Body).Decode(&list)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list.Contents {
+			if ok, _ := path.Match(pattern, c.Key); ok {
+				result = append(result, "s3://"+bucket+"/"+c.Key)
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	return result, nil
+}
+
+// withRetries calls fn until it succeeds, up to remoteRetries times.
+func withRetries(fn func() error) error {
+	var err error
+	wait := remoteBackoff
+	for i := 0; i < remoteRetries; i++ {
+		if i > 0 {
+			log.Printf("indexcov: retrying after error: %s", err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package indexcov
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	chartjs "github.com/brentp/go-chartjs"
+)
+
+// report collects the per-chromosome charts for --single-html. It is nil otherwise.
+var report *singleReport
+
+// singleReport holds the per-chromosome plots to be inlined in a single HTML file.
+// Charts are stored as base64 encoded, gzipped JSON which is decompressed in the browser.
+type singleReport struct {
+	chartJS  template.JS
+	depth    map[string]string
+	roc      map[string]string
+	depthPNG map[string]template.URL
+}
+
+// newSingleReport gets the Chart.js library up front so that a failure is reported before any work is done.
+func newSingleReport() *singleReport {
+	return &singleReport{chartJS: chartJSSource(), depth: make(map[string]string), roc: make(map[string]string), depthPNG: make(map[string]template.URL)}
+}
+
+// compressChart returns the chart as base64 encoded, gzipped JSON.
+func compressChart(c chartjs.Chart) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	b64 := base64.NewEncoder(base64.StdEncoding, &buf)
+	gz, _ := gzip.NewWriterLevel(b64, gzip.BestCompression)
+	gz.Write(js)
+	gz.Close()
+	b64.Close()
+	return buf.String()
+}
+
+// pngURL returns the png at path as a data URL.
+func pngURL(path string) template.URL {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(b))
+}
+
+// addDepth adds the depth plot for chrom. If interactive is false, only the png is used.
+func (r *singleReport) addDepth(chrom string, c chartjs.Chart, interactive bool, png string) {
+	if interactive {
+		r.depth[chrom] = compressChart(c)
+	} else {
+		r.depthPNG[chrom] = pngURL(png)
+	}
+}
+
+func (r *singleReport) addROC(chrom string, c chartjs.Chart) {
+	r.roc[chrom] = compressChart(c)
+}
+
+//go:generate curl -sSfL -o chartjs/Chart.bundle.min.js https://cdnjs.cloudflare.com/ajax/libs/Chart.js/2.6.0/Chart.bundle.min.js
+
+// vendored holds the pinned copy of Chart.js that is inlined by --single-html.
+//
+//go:embed chartjs
+var vendored embed.FS
+
+// chartJSPath is the path of the library in vendored.
+const chartJSPath = "chartjs/Chart.bundle.min.js"
+
+// chartJSSource returns the Chart.js library to inline. It is read from the path in the
+// INDEXCOV_CHARTJS environment variable if set and from the copy embedded in the binary otherwise.
+// If the binary was built without the embedded copy, it is downloaded from chartjs.ChartJS.
+func chartJSSource() template.JS {
+	if p := os.Getenv("INDEXCOV_CHARTJS"); p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			log.Fatalf("indexcov: error reading INDEXCOV_CHARTJS: %s", err)
+		}
+		return template.JS(b)
+	}
+	if b, err := vendored.ReadFile(chartJSPath); err == nil {
+		return template.JS(b)
+	}
+	log.Printf("indexcov: this binary was built without %s. downloading it for --single-html", chartJSPath)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(chartjs.ChartJS)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("status %s", resp.Status)
+	}
+	if err != nil {
+		log.Fatalf("indexcov: unable to download %s for --single-html (%s). set INDEXCOV_CHARTJS to the path of a local copy", chartjs.ChartJS, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("indexcov: error downloading %s: %s", chartjs.ChartJS, err)
+	}
+	return template.JS(b)
+}
+
+// readTable reads a tab-delimited file into rows of cells. A leading '#' is removed from the header.
+func readTable(path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	var rows [][]string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 65536), 16*1024*1024)
+	for sc.Scan() {
+		rows = append(rows, strings.Split(strings.TrimPrefix(sc.Text(), "#"), "\t"))
+	}
+	if err := sc.Err(); err != nil {
+		panic(err)
+	}
+	return rows
+}
+
+// writeSingleHTML writes the index with the library, per-chromosome plots, images and .ped inlined so
+// that it can be viewed without any of the other output files.
+func (r *singleReport) writeSingleHTML(path string, chartMap map[string]interface{}, pedPath string, armsPNG string) {
+	chartMap["single"] = true
+	chartMap["ChartJSSource"] = r.chartJS
+	chartMap["depthData"] = r.depth
+	chartMap["rocData"] = r.roc
+	chartMap["depthPNG"] = r.depthPNG
+	chartMap["ped"] = readTable(pedPath)
+	if hasArms, _ := chartMap["hasArms"].(bool); hasArms {
+		chartMap["armsPNG"] = pngURL(armsPNG)
+	}
+	wtr, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	if err := chartjs.SaveCharts(wtr, chartMap, chartjs.Chart{}); err != nil {
+		panic(err)
+	}
+	if err := wtr.Close(); err != nil {
+		panic(err)
+	}
+}
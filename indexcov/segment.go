@@ -0,0 +1,131 @@
+package indexcov
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// segment is a run of tiles with similar depth in a single sample.
+type segment struct {
+	// start and end are tile indexes (half-open).
+	start, end int
+	// n is the number of (non-zero) tiles used to calculate mean.
+	n    int
+	mean float64
+}
+
+// CN returns the estimated copy-number of the segment.
+func (s segment) CN() int {
+	return int(float64(Ploidy)*s.mean + 0.5)
+}
+
+// segmentThreshold is the t-statistic above which a change-point is accepted.
+const segmentThreshold = 6
+
+// segmentDepths does binary segmentation of a single sample's normalized depths.
+// Tiles with a depth of exactly 0 (centromeres and gaps in the reference) are ignored,
+// as in GetCN. Adjacent segments with the same estimated copy-number are merged.
+func segmentDepths(depths []float32, minTiles int) []segment {
+	pos := make([]int, 0, len(depths))
+	vals := make([]float64, 0, len(depths))
+	for i, d := range depths {
+		if d == 0 {
+			continue
+		}
+		if d > MaxCN {
+			d = MaxCN
+		}
+		pos = append(pos, i)
+		vals = append(vals, float64(d))
+	}
+	return segmentValues(pos, vals, minTiles, func(a, b segment) bool { return a.CN() == b.CN() })
+}
+
+// segmentValues does binary segmentation of vals which are at the tile indexes in pos. Adjacent
+// segments are merged if same returns true for them.
+func segmentValues(pos []int, vals []float64, minTiles int, same func(a, b segment) bool) []segment {
+	if len(vals) < 2*minTiles || minTiles < 1 {
+		return nil
+	}
+	sd := noiseSD(vals)
+	if sd == 0 {
+		sd = 1e-3
+	}
+	cum := make([]float64, len(vals)+1)
+	for i, v := range vals {
+		cum[i+1] = cum[i] + v
+	}
+
+	breaks := []int{0, len(vals)}
+	var split func(s, e int)
+	split = func(s, e int) {
+		if e-s < 2*minTiles {
+			return
+		}
+		total := cum[e] - cum[s]
+		best, bestT := -1, 0.0
+		for k := s + minTiles; k <= e-minTiles; k++ {
+			nl, nr := float64(k-s), float64(e-k)
+			ml := (cum[k] - cum[s]) / nl
+			mr := (total - (cum[k] - cum[s])) / nr
+			t := math.Abs(ml-mr) / (sd * math.Sqrt(1/nl+1/nr))
+			if t > bestT {
+				best, bestT = k, t
+			}
+		}
+		if best == -1 || bestT < segmentThreshold {
+			return
+		}
+		breaks = append(breaks, best)
+		split(s, best)
+		split(best, e)
+	}
+	split(0, len(vals))
+	sort.Ints(breaks)
+
+	segs := make([]segment, 0, len(breaks)-1)
+	for i := 1; i < len(breaks); i++ {
+		s, e := breaks[i-1], breaks[i]
+		seg := segment{start: pos[s], end: pos[e-1] + 1, n: e - s, mean: (cum[e] - cum[s]) / float64(e-s)}
+		if len(segs) > 0 && same(segs[len(segs)-1], seg) {
+			last := &segs[len(segs)-1]
+			last.mean = (last.mean*float64(last.n) + seg.mean*float64(seg.n)) / float64(last.n+seg.n)
+			last.n += seg.n
+			last.end = seg.end
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// noiseSD estimates the standard deviation of the depths from the median absolute
+// difference of adjacent values so that it's not inflated by real changes in copy-number.
+func noiseSD(vals []float64) float64 {
+	if len(vals) < 2 {
+		return 0
+	}
+	diffs := make([]float64, len(vals)-1)
+	for i := 1; i < len(vals); i++ {
+		diffs[i-1] = math.Abs(vals[i] - vals[i-1])
+	}
+	sort.Float64s(diffs)
+	// 1.4826 * MAD for normal data and sqrt(2) because these are differences.
+	return 1.4826 * diffs[len(diffs)/2] / math.Sqrt2
+}
+
+// writeCNVs segments each sample and writes segments where the estimated copy-number
+// differs from expected. expected is the per-sample copy-number for this chromosome.
+// pos holds the bins of the depths with --targets.
+func writeCNVs(w io.Writer, chrom string, depths [][]float32, names []string, expected []int, minTiles int, pos []int) {
+	for k, d := range depths {
+		for _, s := range segmentDepths(d, minTiles) {
+			if s.CN() == expected[k] || s.n < minTiles {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%.3f\t%d\t%d\n", chrom, binStart(pos, s.start), binStart(pos, s.end-1)+cli.BinSize, names[k], s.mean, s.CN(), s.n)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package indexcov
+
+// sexNormalize returns a copy of depths for a sex chromosome scaled so that
+// each sample is in units of the expected ploidy. e.g. for a male with 1 copy
+// of X, values of 0.5 become 1. cns are the copy-number estimates from GetCN.
+// Tiles in pars (the pseudo-autosomal regions) are not scaled and samples with
+// an inferred copy-number of 0 (e.g. Y in females) are left as is. pos holds the
+// bins of the depths with --targets.
+func sexNormalize(depths [][]float32, cns []float64, pars [][2]int, pos []int) [][]float32 {
+	out := make([][]float32, len(depths))
+	for k, d := range depths {
+		cn := int(0.5 + cns[k])
+		if cn < 1 || cn == Ploidy {
+			out[k] = d
+			continue
+		}
+		scale := float32(Ploidy) / float32(cn)
+		out[k] = make([]float32, len(d))
+		for i, v := range d {
+			if inRegions(pars, binIndex(pos, i)) {
+				out[k][i] = v
+			} else {
+				out[k][i] = v * scale
+			}
+		}
+	}
+	return out
+}
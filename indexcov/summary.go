@@ -0,0 +1,150 @@
+package indexcov
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/brentp/goleft"
+	"gonum.org/v1/gonum/mat"
+)
+
+// summaryVersion is incremented when fields in the JSON summary are changed or removed.
+// Fields may be added without changing the version.
+const summaryVersion = 1
+
+// sampleSummary has the per-sample values from the .ped along with the ROC AUC for each chromosome.
+// Values that can not be calculated are null.
+type sampleSummary struct {
+	Sample    string              `json:"sample"`
+	Sex       int                 `json:"sex"`
+	SexCN     map[string]*float64 `json:"sex_cn"`
+	Bins      map[string]int      `json:"bins"`
+	Slope     *float64            `json:"slope"`
+	POut      *float64            `json:"p_out"`
+	PCs       []float64           `json:"pcs"`
+	Mapped    *uint64             `json:"mapped"`
+	Unmapped  *uint64             `json:"unmapped"`
+	ROCAUC    map[string]float64  `json:"roc_auc"`
+	QCPass    bool                `json:"qc_pass"`
+	QCReasons []string            `json:"qc_reasons"`
+	// SexDiscordant is null unless a PED file with the declared sex is given.
+	SexDiscordant *bool `json:"sex_discordant"`
+	// OffTarget is null unless --targets is given.
+	OffTarget *float64 `json:"off_target"`
+	// Platform is from the bam header or is "short-read" or "long-read" from BytesPerRead.
+	Platform     string   `json:"platform"`
+	BytesPerRead *float64 `json:"bytes_per_read"`
+}
+
+// indexcovSummary is written as JSON so that pipelines do not need to parse the .ped and .roc by column.
+type indexcovSummary struct {
+	SchemaVersion int    `json:"schema_version"`
+	Version       string `json:"version"`
+	TileWidth     int    `json:"tile_width"`
+	// MappedUnits is "reads" or, for crais, "bytes".
+	MappedUnits string `json:"mapped_units"`
+	// Chromosomes are those that are plotted.
+	Chromosomes []string        `json:"chromosomes"`
+	Samples     []sampleSummary `json:"samples"`
+}
+
+// jsonFloat returns nil for values that can not be encoded in JSON.
+func jsonFloat(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+// rocAUC returns the area under the coverage ROC curve for each sample. It is the mean scaled
+// coverage with each tile capped at the maximum plotted value.
+func rocAUC(rocs [][]float32) []float64 {
+	aucs := make([]float64, len(rocs))
+	for k, roc := range rocs {
+		for _, r := range roc {
+			aucs[k] += float64(r)
+		}
+		aucs[k] /= slots * slotsMid
+	}
+	return aucs
+}
+
+// mappedUnits returns the units of the mapped and unmapped values.
+func mappedUnits() string {
+	if len(cli.Bam) > 0 && strings.HasSuffix(findIndex(cli.Bam[0]), ".crai") {
+		return "bytes"
+	}
+	return "reads"
+}
+
+// writeSummaryJSON writes the summary. sexes must include the inferred sex in "_inferred" and keys has
+// the sex chromosomes in the order of the .ped. discordant is nil without --ped and offTarget is nil without --targets.
+func writeSummaryJSON(path string, samples []string, sexes map[string][]float64, keys []string, counts []*counter, slopes []float32,
+	pcs *mat.Dense, mapped []uint64, unmapped []uint64, aucs map[string][]float64, chroms []string, qc []qcSample, discordant []bool, offTarget []float64, bytesPerRead []float64) error {
+	s := indexcovSummary{SchemaVersion: summaryVersion, Version: goleft.Version, TileWidth: cli.BinSize, MappedUnits: mappedUnits(),
+		Chromosomes: chroms, Samples: make([]sampleSummary, 0, len(samples))}
+	if s.Chromosomes == nil {
+		s.Chromosomes = []string{}
+	}
+	var npc int
+	if pcs != nil {
+		_, npc = pcs.Dims()
+		if npc > 5 {
+			npc = 5
+		}
+	}
+	for i, name := range samples {
+		cnt := counts[i]
+		if cnt == nil {
+			continue
+		}
+		ss := sampleSummary{Sample: name, Sex: int(sexes["_inferred"][i]), SexCN: make(map[string]*float64, len(keys)),
+			Bins:   map[string]int{"out": cnt.out, "lo": cnt.low, "hi": cnt.hi, "in": cnt.in},
+			Slope:  jsonFloat(float64(slopes[i])),
+			POut:   jsonFloat(float64(cnt.out) / float64(cnt.in)),
+			PCs:    make([]float64, npc),
+			ROCAUC: make(map[string]float64, len(aucs)),
+			QCPass: qc[i].Pass, QCReasons: qc[i].Reasons}
+		for _, k := range keys {
+			ss.SexCN[k] = jsonFloat(sexes[k][i])
+		}
+		for j := range ss.PCs {
+			ss.PCs[j] = pcs.At(i, j)
+		}
+		if mapped != nil {
+			ss.Mapped, ss.Unmapped = &mapped[i], &unmapped[i]
+		}
+		for chrom, auc := range aucs {
+			ss.ROCAUC[chrom] = auc[i]
+		}
+		if discordant != nil {
+			ss.SexDiscordant = &discordant[i]
+		}
+		if offTarget != nil {
+			ss.OffTarget = &offTarget[i]
+		}
+		if i < len(cli.platforms) {
+			ss.Platform = cli.platforms[i]
+		}
+		if bytesPerRead != nil {
+			ss.BytesPerRead = jsonFloat(bytesPerRead[i])
+		}
+		if ss.QCReasons == nil {
+			ss.QCReasons = []string{}
+		}
+		s.Samples = append(s.Samples, ss)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
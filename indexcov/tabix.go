@@ -0,0 +1,117 @@
+package indexcov
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/biogo/hts/sam"
+)
+
+// readTabix reads an uncompressed tabix stream. After the header, which holds the
+// sequence names, a tabix index has the same bins and linear index as a BAI so
+// the 16KB tiles give the change in (compressed) file size as for a bam.
+// The names are kept so that the tiles can be matched to references by name.
+func readTabix(r io.Reader) (*linearIndex, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != [4]byte{'T', 'B', 'I', 0x1} {
+		return nil, errors.New("tbi: magic number mismatch")
+	}
+	// n_ref, format, col_seq, col_beg, col_end, meta, skip, l_nm
+	var hdr [8]int32
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	n, lnm := hdr[0], hdr[7]
+	if n < 0 || lnm < 0 {
+		return nil, errors.New("tbi: invalid header")
+	}
+	nm := make([]byte, lnm)
+	if _, err := io.ReadFull(br, nm); err != nil {
+		return nil, fmt.Errorf("tbi: failed to read sequence names: %v", err)
+	}
+	names := make([]string, 0, n)
+	for _, name := range bytes.Split(bytes.TrimRight(nm, "\x00"), []byte{0}) {
+		names = append(names, string(name))
+	}
+	if len(names) != int(n) {
+		return nil, fmt.Errorf("tbi: expected %d sequence names, found %d", n, len(names))
+	}
+	idx, err := readLinear(br, int(n), "tbi")
+	if err != nil {
+		return nil, err
+	}
+	idx.names = names
+	return idx, nil
+}
+
+// RefsFromTabix returns references from the sequence names in a tabix index. Since tabix
+// does not store the sequence lengths, they are estimated from the number of 16KB tiles.
+// If chrom is "" all chromosomes are returned.
+func RefsFromTabix(path string, chrom string) []*sam.Reference {
+	f, err := openPath(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		panic(err)
+	}
+	idx, err := readTabix(gz)
+	if err != nil {
+		log.Printf("error from index: %s", path)
+		panic(err)
+	}
+	refs := make([]*sam.Reference, 0, len(idx.names))
+	for i, name := range idx.names {
+		if chrom != "" && name != chrom {
+			continue
+		}
+		ref, err := sam.NewReference(name, "", "", (len(idx.sizes[i])+1)*TileWidth, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		panic(fmt.Sprintf("ERROR: didn't find any usable chromosomes in %s", path))
+	}
+	log.Printf("indexcov: using chromosome names from %s. send --fai to use the exact lengths", path)
+	h, err := sam.NewHeader(nil, refs)
+	if err != nil {
+		panic(err)
+	}
+	return h.Refs()
+}
+
+// alignRefs re-orders sizes to match refs by name for indexes, like tabix, that have their own
+// sequence names. A "chr" prefix is ignored. References that are not in the index are empty.
+func (x *Index) alignRefs(refs []*sam.Reference) {
+	if x.names == nil {
+		return
+	}
+	byName := make(map[string]int, len(x.names))
+	for i, name := range x.names {
+		byName[stripChr(name)] = i
+	}
+	sizes := make([][]int64, 0, len(refs))
+	for _, ref := range refs {
+		for len(sizes) <= ref.ID() {
+			sizes = append(sizes, make([]int64, 0))
+		}
+		if i, ok := byName[stripChr(ref.Name())]; ok {
+			sizes[ref.ID()] = x.sizes[i]
+		}
+	}
+	x.sizes, x.names = sizes, nil
+}
@@ -0,0 +1,158 @@
+package indexcov
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"sort"
+
+	"github.com/biogo/hts/sam"
+	"github.com/brentp/goleft/depth"
+)
+
+// targetBins holds the sorted indexes of the bins that overlap a capture region for each reference (by ID).
+// With --targets, only these bins are used so that off-target bins do not dominate exome data.
+type targetBins [][]int
+
+// readTargets finds the bins of each reference that overlap a region in the BED file at path.
+func readTargets(path string, refs []*sam.Reference) targetBins {
+	t, n := readBins(path, refs)
+	if n == 0 {
+		log.Fatalf("indexcov: no bins overlap the regions in %s. check that the chromosome names match", path)
+	}
+	log.Printf("indexcov: using %d bins that overlap regions in %s", n, path)
+	return t
+}
+
+// readBins returns the bins of each reference that overlap a region in the BED file at path and the
+// total number of bins.
+func readBins(path string, refs []*sam.Reference) (targetBins, int) {
+	trees := depth.ReadTree(path)
+	t := make(targetBins, 0, len(refs))
+	n := 0
+	for _, ref := range refs {
+		for len(t) <= ref.ID() {
+			t = append(t, nil)
+		}
+		tree, ok := trees[ref.Name()]
+		if !ok {
+			tree, ok = trees[stripChr(ref.Name())]
+		}
+		if !ok {
+			tree = trees["chr"+ref.Name()]
+		}
+		if tree == nil {
+			continue
+		}
+		bins := make([]int, 0, 16)
+		for i := 0; i*cli.BinSize < ref.Len(); i++ {
+			if depth.Overlaps(tree, i*cli.BinSize, (i+1)*cli.BinSize) {
+				bins = append(bins, i)
+			}
+		}
+		t[ref.ID()] = bins
+		n += len(bins)
+	}
+	return t, n
+}
+
+// contains returns true if bin i of the reference with the given ID is in t. It is false if t is nil.
+func (t targetBins) contains(id, i int) bool {
+	if id >= len(t) {
+		return false
+	}
+	bins := t[id]
+	j := sort.SearchInts(bins, i)
+	return j < len(bins) && bins[j] == i
+}
+
+// hash returns a hash of the bins of reference id so that the bins used by different runs can be compared.
+// It is 0 if there are no bins for the reference.
+func (t targetBins) hash(id int) uint64 {
+	if id >= len(t) || len(t[id]) == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	for _, b := range t[id] {
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(b)))
+	}
+	return h.Sum64()
+}
+
+// sizes returns the sizes in the target bins that are not in mask. mask may be nil.
+func (t targetBins) sizes(all [][]int64, mask targetBins) []int64 {
+	sizes := make([]int64, 0, 16384)
+	for id, bins := range t {
+		if id >= len(all) {
+			break
+		}
+		for _, i := range bins {
+			if i < len(all[id]) && !mask.contains(id, i) {
+				sizes = append(sizes, all[id][i])
+			}
+		}
+	}
+	return sizes
+}
+
+// offTarget returns the proportion of the total size that is in bins that do not overlap any target.
+func (t targetBins) offTarget(all [][]int64) float64 {
+	var total, on int64
+	for _, s := range all {
+		for _, v := range s {
+			total += v
+		}
+	}
+	for _, v := range t.sizes(all, nil) {
+		on += v
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(total-on) / float64(total)
+}
+
+// gatherBins returns the values of d at the bins in pos. Bins beyond the end of d are skipped.
+func gatherBins(d []float32, pos []int) []float32 {
+	out := make([]float32, 0, len(pos))
+	for _, p := range pos {
+		if p >= len(d) {
+			break
+		}
+		out = append(out, d[p])
+	}
+	return out
+}
+
+func gatherBins64(d []float64, pos []int) []float64 {
+	out := make([]float64, 0, len(pos))
+	for _, p := range pos {
+		if p >= len(d) {
+			break
+		}
+		out = append(out, d[p])
+	}
+	return out
+}
+
+// binIndex returns the bin of the i'th value for a chromosome where pos holds the bins that were kept.
+// If pos is nil, all bins were kept.
+func binIndex(pos []int, i int) int {
+	if pos == nil {
+		return i
+	}
+	return pos[i]
+}
+
+// binStart returns the genomic start of the i'th value for a chromosome with the kept bins in pos.
+func binStart(pos []int, i int) int {
+	return binIndex(pos, i) * cli.BinSize
+}
+
+// searchBins returns the index of the first value at or after bin i.
+func searchBins(pos []int, i int) int {
+	if pos == nil {
+		return i
+	}
+	return sort.SearchInts(pos, i)
+}
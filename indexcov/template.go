@@ -6,8 +6,13 @@ const chartTemplate = `<!DOCTYPE html>
 {{ $name := index . "name" }}
 {{ $has_sex := index . "hasSex" }}
 	<title>{{ $name }}:indexcov</title>
+{{ $single := index . "single" }}
+{{ if $single }}
+		<script>{{ index . "ChartJSSource" }}</script>
+{{ else }}
 		<script src="{{ index . "JQuery" }}"></script>
 		<script src="{{ index . "ChartJS" }}"></script>
+{{ end }}
 		<style type="text/css">
 section {
     width: 96%;
@@ -51,6 +56,20 @@ section {
     padding: 2px;
 }
 
+.ped {
+	font-size: 0.8em;
+	border-collapse: collapse;
+}
+.ped td, .ped th {
+	border: 1px solid #ddd;
+	padding: 2px 4px;
+}
+
+.qc td {
+	background-color: #f4c7c3;
+	padding: 2px 8px;
+}
+
 .one {
     width: 48%;
     height: 380px;
@@ -103,6 +122,90 @@ Click the <span class="help">?</span> above each plot for help describing that t
 	</section>
 	<hr>
 
+{{ if index . "hasQC" }}
+<section style="height:auto">
+	<span class="tt">QC</span>
+	{{ $failed := index . "qcFailed" }}
+	{{ if $failed }}
+	<p>{{ len $failed }} sample(s) are outliers relative to the cohort. see <a href="{{ $name }}-indexcov.qc.json">{{ $name }}-indexcov.qc.json</a> for all scores.</p>
+	<table class="qc">
+	<tr><th>sample</th><th>reasons</th></tr>
+	{{ range $failed }}
+	<tr><td>{{ .Sample }}</td><td>{{ range $i, $r := .Reasons }}{{ if $i }}, {{ end }}{{ $r }}{{ end }}</td></tr>
+	{{ end }}
+	</table>
+	{{ else }}
+	<p>all samples passed QC. see <a href="{{ $name }}-indexcov.qc.json">{{ $name }}-indexcov.qc.json</a> for all scores.</p>
+	{{ end }}
+</section><hr/>
+{{ end }}
+
+{{ $samples := index . "samples" }}
+{{ if $samples }}
+<section style="height:auto">
+	<span class="tt">Samples</span>
+	<p>{{ if not $single }}click a sample for a plot of its scaled coverage across the genome. {{ end }}samples that failed QC or have a discordant sex are highlighted.</p>
+	<div style="max-height:400px;overflow-y:auto">
+	<table class="ped">
+	<tr><th>sample</th><th>flags</th>{{ if not $single }}<th>genome-wide coverage</th>{{ end }}</tr>
+	{{ range $samples }}
+	{{ if $single }}
+	<tr><td{{ if .Flags }} style="background-color:#f4c7c3"{{ end }}>{{ .Sample }}</td>
+	<td>{{ range $i, $f := .Flags }}{{ if $i }}, {{ end }}{{ $f }}{{ end }}</td></tr>
+	{{ else }}
+	<tr><td{{ if .Flags }} style="background-color:#f4c7c3"{{ end }}><a href="{{ $name }}-indexcov-sample-{{ .File }}.{{ if index $ "notmany" }}html{{ else }}png{{ end }}">{{ .Sample }}</a></td>
+	<td>{{ range $i, $f := .Flags }}{{ if $i }}, {{ end }}{{ $f }}{{ end }}</td>
+	<td>{{ if index $ "notmany" }}<a href="{{ $name }}-indexcov-sample-{{ .File }}.html">html</a> {{ end }}<a href="{{ $name }}-indexcov-sample-{{ .File }}.png">png</a></td></tr>
+	{{ end }}
+	{{ end }}
+	</table>
+	</div>
+</section><hr/>
+{{ end }}
+
+{{ if index . "hasRelatedness" }}
+<section style="height:auto">
+	<span class="tt">Duplicates and Sex Checks</span>
+	{{ $dups := index . "duplicates" }}
+	{{ if $dups }}
+	<p>{{ len $dups }} pair(s) of samples have nearly identical coverage profiles and may be duplicates or swaps.
+	see <a href="{{ $name }}-indexcov.relatedness.tsv">{{ $name }}-indexcov.relatedness.tsv</a> for details.</p>
+	<table class="qc">
+	<tr><th>sample</th><th>sample</th><th>correlation</th><th>flags</th></tr>
+	{{ range $dups }}
+	<tr><td>{{ .A }}</td><td>{{ .B }}</td><td>{{ printf "%.3f" .Correlation }}</td><td>{{ .Flags }}</td></tr>
+	{{ end }}
+	</table>
+	{{ else }}
+	<p>no pairs of samples have nearly identical coverage profiles.</p>
+	{{ end }}
+	{{ $sex := index . "sexDiscordant" }}
+	{{ if $sex }}
+	<p>{{ len $sex }} sample(s) have a declared sex (1=male, 2=female) that differs from the inferred sex.</p>
+	<table class="qc">
+	<tr><th>sample</th><th>declared</th><th>inferred</th></tr>
+	{{ range $sex }}
+	<tr><td>{{ .Sample }}</td><td>{{ .Declared }}</td><td>{{ .Inferred }}</td></tr>
+	{{ end }}
+	</table>
+	{{ end }}
+</section><hr/>
+{{ end }}
+
+{{ if $single }}
+<section style="height:auto">
+	<span class="tt">Pedigree File</span>
+	<p>contains inferred sex, bins counts, and PCA values used to make the above plots</p>
+	<div style="overflow-x:auto">
+	<table class="ped">
+	{{ range $i, $row := index . "ped" }}
+	<tr>{{ range $row }}{{ if $i }}<td>{{ . }}</td>{{ else }}<th>{{ . }}</th>{{ end }}{{ end }}</tr>
+	{{ end }}
+	</table>
+	</div>
+</section><hr/>
+{{ end }}
+
 <!-- links to download files; need to override height -->
 <section style="height:auto">
 	<div class="one" style="height:auto">
@@ -113,16 +216,76 @@ Click the <span class="help">?</span> above each plot for help describing that t
 
 	<div class="two" style="height:auto">
 	<span class="tt">Coverage BED File</span>
-	<p>contains scaled coverage for every sample (each column) for each 16,384 interval in the index</p>
+	<p>contains scaled coverage for every sample (each column) for each {{ index . "binSize" }} base interval</p>
 	<a href="{{ $name }}-indexcov.bed.gz">{{ $name }}-indexcov.bed.gz</a>
 	</div>
 
 </section><hr/>
 
+{{ if index . "hasCNV" }}
+<section style="height:auto">
+	<div class="one" style="height:auto">
+	<span class="tt">CNV BED File</span>
+	<p>contains segments of each sample with an estimated copy-number that differs from expected</p>
+	<a href="{{ $name }}-indexcov.cnv.bed">{{ $name }}-indexcov.cnv.bed</a>
+	</div>
+</section><hr/>
+{{ end }}
+
+
+{{ if index . "hasArms" }}
+<section style="height:auto">
+	<span class="tt">Copy-number by chromosome arm</span>
+	<p>each row is a sample colored by estimated copy-number (blue is loss; red is gain). values that are not near an integer are possible mosaics.
+	see <a href="{{ $name }}-indexcov.arms.tsv">{{ $name }}-indexcov.arms.tsv</a> for values and flagged arms.</p>
+	<img src="{{ if $single }}{{ index . "armsPNG" }}{{ else }}{{ $name }}-indexcov-arms.png{{ end }}" style="max-width:100%" />
+</section><hr/>
+{{ end }}
+
+{{ $pairs := index . "pairs" }}
+{{ if $pairs }}
+<section style="height:auto">
+	<span class="tt">Tumor/Normal log2 ratios</span>
+	<p>arms with a median log2(tumor/normal) beyond &plusmn;0.15. these are not adjusted for purity.
+	see <a href="{{ $name }}-indexcov-pairs.arms.tsv">{{ $name }}-indexcov-pairs.arms.tsv</a> for values and
+	<a href="{{ $name }}-indexcov-pairs.seg.bed">{{ $name }}-indexcov-pairs.seg.bed</a> for segments.</p>
+	<table class="ped">
+	<tr><th>tumor</th><th>normal</th><th>gains</th><th>losses</th><th>plot</th></tr>
+	{{ range $pairs }}
+	<tr><td>{{ .Tumor }}</td><td>{{ .Normal }}</td><td>{{ range $i, $a := .Gains }}{{ if $i }}, {{ end }}{{ $a }}{{ end }}</td>
+	<td>{{ range $i, $a := .Losses }}{{ if $i }}, {{ end }}{{ $a }}{{ end }}</td>
+	<td><a href="{{ $name }}-indexcov-pair-{{ .Name }}.html">html</a> <a href="{{ $name }}-indexcov-pair-{{ .Name }}.png">png</a></td></tr>
+	{{ end }}
+	</table>
+</section><hr/>
+{{ end }}
+
+{{ $regions := index . "regions" }}
+{{ if $regions }}
+<section style="height:auto">
+	<span class="tt">Regions</span>
+	<p>number of samples with a mean scaled coverage below 0.75 (possible loss) or above 1.25 (possible gain) in each region.
+	{{ if not $single }}see <a href="{{ $name }}-indexcov.regions.tsv">{{ $name }}-indexcov.regions.tsv</a> for the mean of every sample.{{ end }}</p>
+	<table class="ped">
+	<tr><th>region</th><th>location</th><th>low</th><th>high</th>{{ if not $single }}<th>bins</th><th>plot</th>{{ end }}</tr>
+	{{ range $regions }}
+	<tr><td>{{ .Name }}</td><td>{{ .Location }}</td><td>{{ .Low }}</td><td>{{ .High }}</td>
+	{{ if not $single }}
+	<td><a href="{{ $name }}-indexcov-region-{{ .Name }}.tsv">tsv</a></td>
+	<td>{{ if index $ "notmany" }}<a href="{{ $name }}-indexcov-region-{{ .Name }}.html">html</a> {{ end }}<a href="{{ $name }}-indexcov-region-{{ .Name }}.png">png</a></td>
+	{{ end }}
+	</tr>
+	{{ end }}
+	</table>
+</section><hr/>
+{{ end }}
 
 {{ if index . "hasPCA" }}
 
 <section style="height:auto">
+	{{ if index . "pcaModel" }}
+	<p>Samples are projected onto the PCs of the reference cohort in {{ index . "pcaModel" }} which is shown in gray.</p>
+	{{ end }}
 	<div class="one">
 	<span class="tt">PCA: 1 vs 2</span>
 	<a class="help" href="https://github.com/brentp/goleft/blob/master/docs/indexcov/help-pca.md" target="_blank">?</a>
@@ -139,20 +302,40 @@ Click the <span class="help">?</span> above each plot for help describing that t
 
 {{ end }}
 
-<section style="height:auto">
 {{ $notmany := index . "notmany" }}
+{{ $chroms := index . "chroms" }}
+{{ if $single }}
+<section style="height:auto">
+	<span class="tt">Depth and Coverage Plots</span>
+	<a class="help" href="https://github.com/brentp/goleft/blob/master/docs/indexcov/help-depth.md" target="_blank">?</a>
+	<select id="chrom-select" onchange="showChrom(this.value)">
+	{{ range $chroms }}<option value="{{ . }}">{{ . }}</option>{{ end }}
+	</select>
+	<div>
+	{{ if $notmany }}
+	<canvas id="canvas-depth" style="height:550px;width:850px"></canvas>
+	{{ else }}
+	<img id="img-depth" />
+	{{ end }}
+	<canvas id="canvas-roc" style="height:550px;width:650px"></canvas>
+	</div>
+</section>
+{{ end }}
 
+<section style="height:auto">
+
+{{ if not $single }}
 	<div class="one">
 	<span class="tt">Coverage Plots</span> <a class="help" href="https://github.com/brentp/goleft/blob/master/docs/indexcov/help-depth.md#coverage" target="_blank">?</a>
 	<p>Click each plot for an interactive view.</p>
 
-	{{ $chroms := index . "chroms" }}
 	{{ range $idx, $chrom := $chroms }}
 		<p>
 		<a href="{{ $name }}-indexcov-roc-{{ $chrom }}.html"><img src="{{ $name }}-indexcov-roc-{{ $chrom }}.png" /></a>
 		</p>
 	{{ end }}
 
+{{ end }}
 <hr/>
 <h5>Acknowledgements</h5>
 <ul>
@@ -163,6 +346,7 @@ Click the <span class="help">?</span> above each plot for help describing that t
 </ul>
 
 	</div>
+{{ if not $single }}
 	<div class="two">
 	<span class="tt">Depth Plots</span> <a class="help" href="https://github.com/brentp/goleft/blob/master/docs/indexcov/help-depth.md" target="_blank">?</a>
 	<p>
@@ -180,6 +364,7 @@ Click the <span class="help">?</span> above each plot for help describing that t
 		</p>
 	{{ end }}
 	</div>
+{{ end }}
 
 
     </body>
@@ -224,6 +409,34 @@ Click the <span class="help">?</span> above each plot for help describing that t
 	var chart = pcb_chart
 	{{ index . "pcbjs" }}
 
+{{ if $single }}
+	var depthData = {{ index . "depthData" }};
+	var depthPNG = {{ index . "depthPNG" }};
+	var rocData = {{ index . "rocData" }};
+	var depth_chart = null, roc_chart = null;
+
+	// charts are base64 encoded, gzipped JSON.
+	async function loadChart(b64) {
+		var bytes = Uint8Array.from(atob(b64), function(c) { return c.charCodeAt(0) });
+		var stream = new Blob([bytes]).stream().pipeThrough(new DecompressionStream("gzip"));
+		return await new Response(stream).json();
+	}
+
+	async function showChrom(chrom) {
+		if (depth_chart) { depth_chart.destroy(); depth_chart = null }
+		if (roc_chart) { roc_chart.destroy(); roc_chart = null }
+		if (chrom in depthData) {
+			depth_chart = new Chart(document.getElementById("canvas-depth").getContext("2d"), await loadChart(depthData[chrom]));
+		} else if (chrom in depthPNG) {
+			document.getElementById("img-depth").src = depthPNG[chrom];
+		}
+		if (chrom in rocData) {
+			roc_chart = new Chart(document.getElementById("canvas-roc").getContext("2d"), await loadChart(rocData[chrom]));
+		}
+	}
+	var sel = document.getElementById("chrom-select");
+	if (sel.value) { showChrom(sel.value) }
+{{ end }}
     </script>
 </html>
 `
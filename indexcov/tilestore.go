@@ -0,0 +1,213 @@
+package indexcov
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/biogo/hts/sam"
+)
+
+// tileStore spills the normalized depths of each sample to disk as they are read so that the sizes for
+// every sample are never in memory and run can load a single chromosome for all samples at once. All of the
+// chromosomes share a single file so that assemblies with many contigs do not need a file for each.
+type tileStore struct {
+	dir string
+	f   *os.File
+	mu  sync.Mutex
+	// end is the current size of the file.
+	end int64
+	// used is true for the chromosomes (by ref ID) that are stored.
+	used []bool
+	// offs and lens give the byte offset and number of tiles for each chromosome (by ref ID) and sample.
+	offs [][]int64
+	lens [][]int32
+}
+
+// newTileStore creates a store in a new temporary directory in dir.
+func newTileStore(dir string, refs []*sam.Reference, nSamples int) (*tileStore, error) {
+	tmp, err := os.MkdirTemp(dir, ".indexcov-tiles-")
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, ref := range refs {
+		if ref.ID() >= n {
+			n = ref.ID() + 1
+		}
+	}
+	s := &tileStore{dir: tmp, used: make([]bool, n), offs: make([][]int64, n), lens: make([][]int32, n)}
+	if s.f, err = os.Create(tmp + "/tiles.f32"); err != nil {
+		s.close()
+		return nil, err
+	}
+	for _, ref := range refs {
+		if cli.exclude != nil && cli.exclude.Match([]byte(ref.Name())) {
+			continue
+		}
+		id := ref.ID()
+		s.used[id] = true
+		s.offs[id] = make([]int64, nSamples)
+		s.lens[id] = make([]int32, nSamples)
+	}
+	return s, nil
+}
+
+// add writes the normalized depths of sample i for each chromosome in the store.
+func (s *tileStore) add(i int, idx *Index) {
+	var buf []byte
+	offs := make([]int64, len(s.used))
+	for id, ok := range s.used {
+		if !ok {
+			continue
+		}
+		d := idx.NormalizedDepth(id)
+		offs[id] = int64(len(buf))
+		for _, v := range d {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+		}
+		s.lens[id][i] = int32(len(d))
+	}
+	s.mu.Lock()
+	off := s.end
+	s.end += int64(len(buf))
+	s.mu.Unlock()
+	if _, err := s.f.WriteAt(buf, off); err != nil {
+		log.Fatalf("indexcov: error writing temporary file: %s", err)
+	}
+	for id, ok := range s.used {
+		if ok {
+			s.offs[id][i] = off + offs[id]
+		}
+	}
+}
+
+// depths reads the depths of every sample for the chromosome with the given ref ID into dst.
+func (s *tileStore) depths(id int, dst [][]float32) {
+	var buf []byte
+	for i := range dst {
+		if id >= len(s.used) || !s.used[id] {
+			dst[i] = dst[i][:0]
+			continue
+		}
+		n := int(s.lens[id][i])
+		if cap(buf) < 4*n {
+			buf = make([]byte, 4*n)
+		}
+		buf = buf[:4*n]
+		if _, err := s.f.ReadAt(buf, s.offs[id][i]); err != nil {
+			log.Fatalf("indexcov: error reading temporary file: %s", err)
+		}
+		// a new slice since depths are kept by some callers (e.g. plots).
+		d := make([]float32, n)
+		for k := range d {
+			d[k] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*k:]))
+		}
+		dst[i] = d
+	}
+}
+
+// close removes the temporary file.
+func (s *tileStore) close() {
+	if s.f != nil {
+		s.f.Close()
+	}
+	os.RemoveAll(s.dir)
+}
+
+// parseMemory parses a size such as 512M or 16G into bytes. A bare number is in bytes and "" is 0.
+func parseMemory(m string) (int64, error) {
+	m = strings.ToUpper(strings.TrimSpace(m))
+	if m == "" {
+		return 0, nil
+	}
+	m = strings.TrimSuffix(m, "B")
+	mult := 1.0
+	if len(m) > 0 {
+		switch m[len(m)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			m = m[:len(m)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(m, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("indexcov: invalid memory size: %s", m)
+	}
+	return int64(v * mult), nil
+}
+
+// pcaBytesPerTile is the approximate memory used per sample and tile by the matrices in pca.
+const pcaBytesPerTile = 1 + 3*8
+
+// depthBytesPerTile is the approximate memory used per sample and tile for a chromosome in run
+// accounting for the copies made for normalization and output.
+const depthBytesPerTile = 3 * 4
+
+// pcaStride returns the interval between tiles used for the PCA so that the matrices use at most
+// half of maxMem. 0 means there is no limit. With --pca-model, the interval from the model is used.
+func pcaStride(refs []*sam.Reference, nSamples int, maxMem int64) int {
+	if cli.PCAModel != "" {
+		m, err := readPCAModel(cli.PCAModel)
+		if err != nil {
+			log.Fatalf("indexcov: error reading PCA model from %s: %s", cli.PCAModel, err)
+		}
+		return m.Stride
+	}
+	if maxMem <= 0 {
+		return 1
+	}
+	var tiles, longest int64
+	for _, ref := range refs {
+		if (cli.exclude != nil && cli.exclude.Match([]byte(ref.Name()))) || sameChrom(cli.sex, ref.Name()) {
+			continue
+		}
+		n := int64(ref.Len()/cli.BinSize + 1)
+		tiles += n
+		if n > longest {
+			longest = n
+		}
+	}
+	if need := longest * int64(nSamples) * depthBytesPerTile; need > maxMem/2 {
+		log.Printf("indexcov: WARNING: the longest chromosome for all samples needs ~%dMB which is more than half of --max-memory", need>>20)
+	}
+	stride := int(math.Ceil(float64(tiles*int64(nSamples)*pcaBytesPerTile) / float64(maxMem/2)))
+	if stride > 1 {
+		log.Printf("indexcov: using every %dth tile for PCA to stay within --max-memory", stride)
+		return stride
+	}
+	return 1
+}
+
+// genomeBytesPerPoint is the memory used per sample and point of the genome-wide plots.
+const genomeBytesPerPoint = 4
+
+// genomePoints returns the number of points for each sample in the genome-wide plots so that they use
+// at most an eighth of maxMem. 0 means there is no limit.
+func genomePoints(nSamples int, maxMem int64) int {
+	if maxMem <= 0 || nSamples == 0 {
+		return genomeMaxPoints
+	}
+	n := maxMem / 8 / (int64(nSamples) * genomeBytesPerPoint)
+	if n >= genomeMaxPoints {
+		return genomeMaxPoints
+	}
+	if n < 1 {
+		n = 1
+	}
+	log.Printf("indexcov: using %d points for the genome-wide plot of each sample to stay within --max-memory", n)
+	return int(n)
+}
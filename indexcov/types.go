@@ -1,12 +1,12 @@
 package indexcov
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"reflect"
-	"unsafe"
-
-	"github.com/biogo/hts/bam"
-	"github.com/biogo/hts/bgzf"
 )
 
 const (
@@ -19,64 +19,107 @@ const (
 	StatsDummyBin = 0x924a
 )
 
-type oRefIndex struct {
-	Bins      []bin
-	Stats     *referenceStats
-	Intervals []bgzf.Offset
-}
-
-type bin struct {
-	Bin    uint32
-	Chunks []bgzf.Chunk
+// linearIndex holds the byte delta for each 16KB tile along with the
+// mapped and unmapped counts from the pseudo-bins of a BAI, CSI or tabix index.
+type linearIndex struct {
+	sizes    [][]int64
+	mapped   uint64
+	unmapped uint64
+	// names are the sequence names from a tabix index and nil otherwise.
+	names []string
 }
 
-type referenceStats struct {
-	// Chunk is the span of the indexed BGZF
-	// holding alignments to the reference.
-	Chunk bgzf.Chunk
-
-	// Mapped is the count of mapped reads.
-	Mapped uint64
-
-	// Unmapped is the count of unmapped reads.
-	Unmapped uint64
+// readBAI reads a BAI index keeping only the linear index and the
+// reference stats. The bins and chunks are skipped rather than stored so
+// this uses much less memory than bam.ReadIndex.
+func readBAI(r io.Reader) (*linearIndex, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != [4]byte{'B', 'A', 'I', 0x1} {
+		return nil, errors.New("bai: magic number mismatch")
+	}
+	var n int32
+	if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("bai: invalid number of references: %d", n)
+	}
+	return readLinear(br, int(n), "bai")
 }
 
-func getSizes(idx *bam.Index) ([][]int64, uint64, uint64) {
-	var mapped, unmapped uint64
-	refs := reflect.ValueOf(*idx).FieldByName("idx").FieldByName("Refs")
-	ptr := unsafe.Pointer(refs.Pointer())
-
-	ret := (*(*[1 << 28]oRefIndex)(ptr))[:refs.Len()]
-	// save some memory.
-	m := make([][]int64, len(ret))
-	n_messages := 0
-	for i, r := range ret {
-		st, ok := idx.ReferenceStats(i)
-		if ok {
-			mapped += st.Mapped
-			unmapped += st.Unmapped
-		} else {
-			if n_messages <= 10 {
+// readLinear reads the per-reference bins and linear index shared by BAI and tabix.
+// typ is used in error messages.
+func readLinear(br *bufio.Reader, n int, typ string) (*linearIndex, error) {
+	idx := &linearIndex{sizes: make([][]int64, n)}
+	var offs []uint64
+	nMessages := 0
+	for i := range idx.sizes {
+		var nBin int32
+		if err := binary.Read(br, binary.LittleEndian, &nBin); err != nil {
+			return nil, err
+		}
+		hasStats := false
+		for b := int32(0); b < nBin; b++ {
+			var hdr [2]uint32
+			if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+				return nil, fmt.Errorf("%s: failed to read bin: %v", typ, err)
+			}
+			if hdr[0] == StatsDummyBin {
+				if hdr[1] != 2 {
+					return nil, fmt.Errorf("%s: malformed dummy bin header", typ)
+				}
+				var stats [4]uint64
+				if err := binary.Read(br, binary.LittleEndian, &stats); err != nil {
+					return nil, fmt.Errorf("%s: failed to read index stats: %v", typ, err)
+				}
+				idx.mapped += stats[2]
+				idx.unmapped += stats[3]
+				hasStats = true
+				continue
+			}
+			if _, err := br.Discard(16 * int(hdr[1])); err != nil {
+				return nil, fmt.Errorf("%s: failed to read chunks: %v", typ, err)
+			}
+		}
+		// tabix indexes are often written without the stats pseudo-bin.
+		if !hasStats && typ != "tbi" {
+			if nMessages <= 10 {
 				log.Printf("no reference stats found for %dth reference chromosome", i)
 			}
-			if n_messages == 10 {
+			if nMessages == 10 {
 				log.Printf("not reporting further chromosomes without stats. %d", i)
 			}
-			n_messages += 1
+			nMessages++
+		}
+
+		var nIntv int32
+		if err := binary.Read(br, binary.LittleEndian, &nIntv); err != nil {
+			return nil, err
+		}
+		if cap(offs) < int(nIntv) {
+			offs = make([]uint64, nIntv)
+		}
+		offs = offs[:nIntv]
+		if err := binary.Read(br, binary.LittleEndian, offs); err != nil {
+			return nil, fmt.Errorf("%s: failed to read tile interval virtual offset: %v", typ, err)
 		}
-		if len(r.Intervals) < 2 {
-			m[i] = make([]int64, 0)
+		if len(offs) < 2 {
+			idx.sizes[i] = make([]int64, 0)
 			continue
 		}
-		m[i] = make([]int64, len(r.Intervals)-1)
-		for k, iv := range r.Intervals[1:] {
-			m[i][k] = vOffset(iv) - vOffset(r.Intervals[k])
-			if m[i][k] < 0 {
-				panic("expected positive change in vOffset")
+		sizes := make([]int64, len(offs)-1)
+		for k, o := range offs[1:] {
+			if o < offs[k] {
+				return nil, fmt.Errorf("%s: linear index offset of tile %d is before that of tile %d for reference %d", typ, k+1, k, i)
 			}
+			sizes[k] = int64(o - offs[k])
 		}
-		r.Bins, r.Intervals = nil, nil
+		idx.sizes[i] = sizes
 	}
-	return m, mapped, unmapped
+	// the optional n_no_coor is not needed.
+	return idx, nil
 }
@@ -0,0 +1,480 @@
+package indexcov
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	chartjs "github.com/brentp/go-chartjs"
+	"github.com/brentp/go-chartjs/types"
+	"github.com/brentp/xopen"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// zoomFlank is the number of bins on either side of a region that are shown in its chart.
+const zoomFlank = 20
+
+// zoomLow and zoomHigh are the mean scaled depths in a region below and above which a sample is counted
+// as a possible loss or gain in index.html.
+const zoomLow = 0.75
+const zoomHigh = 1.25
+
+// zoomRegion is a locus from --region or --regions.
+type zoomRegion struct {
+	Name  string
+	Chrom string
+	// Start and End are 0-based and half-open.
+	Start, End int
+	// Low and High are the number of samples with a mean depth below zoomLow and above zoomHigh.
+	Low, High int
+	// means has the mean scaled depth of each sample in the bins that overlap the region.
+	means []float64
+}
+
+// Location returns the region as chrom:start-end with a 1-based start.
+func (r *zoomRegion) Location() string {
+	return fmt.Sprintf("%s:%d-%d", r.Chrom, r.Start+1, r.End)
+}
+
+// zoomGene is a gene from --genes used to annotate the region charts.
+type zoomGene struct {
+	name       string
+	start, end int
+}
+
+var unsafeName = regexp.MustCompile(`[^\w.\-]+`)
+
+// parseRegion parses chr:start-end with a 1-based start. Commas in the positions are ignored.
+func parseRegion(s string) (*zoomRegion, error) {
+	colon := strings.LastIndex(s, ":")
+	if colon < 1 {
+		return nil, fmt.Errorf("indexcov: expected region as chr:start-end. got: %s", s)
+	}
+	se := strings.SplitN(strings.Replace(s[colon+1:], ",", "", -1), "-", 2)
+	if len(se) != 2 {
+		return nil, fmt.Errorf("indexcov: expected region as chr:start-end. got: %s", s)
+	}
+	start, e1 := strconv.Atoi(se[0])
+	end, e2 := strconv.Atoi(se[1])
+	if e1 != nil || e2 != nil || start < 1 || end < start {
+		return nil, fmt.Errorf("indexcov: bad positions in region: %s", s)
+	}
+	chrom := s[:colon]
+	return &zoomRegion{Name: fmt.Sprintf("%s-%d-%d", chrom, start, end), Chrom: chrom, Start: start - 1, End: end}, nil
+}
+
+// readZoomRegions returns the region from --region and those in the BED file from --regions. Regions are
+// named by the 4th column of the BED if it is present. The chromosomes are matched to the refs with or
+// without a "chr" prefix.
+func readZoomRegions(region string, path string, refs []*sam.Reference) ([]*zoomRegion, error) {
+	var regions []*zoomRegion
+	if region != "" {
+		r, err := parseRegion(region)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, r)
+	}
+	if path != "" {
+		rdr, err := xopen.Ropen(path)
+		if err != nil {
+			return nil, err
+		}
+		defer rdr.Close()
+		br := bufio.NewReader(rdr)
+		for {
+			line, err := br.ReadString('\n')
+			if len(line) > 0 && line[0] != '#' && !strings.HasPrefix(line, "track") && strings.TrimSpace(line) != "" {
+				toks := strings.Split(strings.TrimSpace(line), "\t")
+				if len(toks) < 3 {
+					return nil, fmt.Errorf("indexcov: expected at least 3 columns in %s: %s", path, line)
+				}
+				start, e1 := strconv.Atoi(toks[1])
+				end, e2 := strconv.Atoi(toks[2])
+				if e1 != nil || e2 != nil || end <= start {
+					return nil, fmt.Errorf("indexcov: bad line in %s: %s", path, line)
+				}
+				name := fmt.Sprintf("%s-%d-%d", toks[0], start+1, end)
+				if len(toks) > 3 && toks[3] != "" {
+					name = toks[3]
+				}
+				regions = append(regions, &zoomRegion{Name: name, Chrom: toks[0], Start: start, End: end})
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	names := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		names[ref.Name()] = true
+	}
+	seen := make(map[string]int, len(regions))
+	for _, r := range regions {
+		r.Name = unsafeName.ReplaceAllString(r.Name, "_")
+		// keep the names unique as they are used in the paths.
+		if n := seen[r.Name]; n > 0 {
+			name := r.Name
+			for ; seen[r.Name] > 0; n++ {
+				r.Name = fmt.Sprintf("%s_%d", name, n+1)
+			}
+			seen[name] = n
+		}
+		seen[r.Name] = 1
+		switch {
+		case names[r.Chrom]:
+		case names[stripChr(r.Chrom)]:
+			r.Chrom = stripChr(r.Chrom)
+		case names["chr"+r.Chrom]:
+			r.Chrom = "chr" + r.Chrom
+		default:
+			return nil, fmt.Errorf("indexcov: chromosome for region %s not found in the indexes", r.Name)
+		}
+	}
+	return regions, nil
+}
+
+// readGenes reads the genes from a BED file (with the name in the 4th column) or a GTF (with the span of all
+// features of each gene_name) that are within zoomFlank bins of any of the regions.
+func readGenes(path string, regions []*zoomRegion) (map[string][]zoomGene, error) {
+	rdr, err := xopen.Ropen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	near := func(chrom string, start, end int) bool {
+		for _, r := range regions {
+			if stripChr(r.Chrom) == stripChr(chrom) && start < r.End+zoomFlank*cli.BinSize && end > r.Start-zoomFlank*cli.BinSize {
+				return true
+			}
+		}
+		return false
+	}
+	gtfName := regexp.MustCompile(`gene_name "([^"]+)"`)
+	gtfID := regexp.MustCompile(`gene_id "([^"]+)"`)
+	genes := make(map[string][]zoomGene)
+	// spans merges the features of each gene from a GTF.
+	spans := make(map[string]int)
+	br := bufio.NewReader(rdr)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && line[0] != '#' && !strings.HasPrefix(line, "track") && strings.TrimSpace(line) != "" {
+			toks := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+			if len(toks) < 3 {
+				return nil, fmt.Errorf("indexcov: expected at least 3 columns in %s: %s", path, line)
+			}
+			var g zoomGene
+			var e1, e2 error
+			if len(toks) >= 9 {
+				// GTF is 1-based.
+				g.start, e1 = strconv.Atoi(toks[3])
+				g.end, e2 = strconv.Atoi(toks[4])
+				g.start--
+				m := gtfName.FindStringSubmatch(toks[8])
+				if m == nil {
+					m = gtfID.FindStringSubmatch(toks[8])
+				}
+				if m != nil {
+					g.name = m[1]
+				}
+			} else {
+				g.start, e1 = strconv.Atoi(toks[1])
+				g.end, e2 = strconv.Atoi(toks[2])
+				if len(toks) > 3 {
+					g.name = toks[3]
+				}
+			}
+			if e1 != nil || e2 != nil {
+				return nil, fmt.Errorf("indexcov: bad line in %s: %s", path, line)
+			}
+			if near(toks[0], g.start, g.end) {
+				chrom := stripChr(toks[0])
+				key := chrom + "\t" + g.name
+				if i, ok := spans[key]; ok && len(toks) >= 9 && g.name != "" {
+					o := &genes[chrom][i]
+					if g.start < o.start {
+						o.start = g.start
+					}
+					if g.end > o.end {
+						o.end = g.end
+					}
+				} else {
+					spans[key] = len(genes[chrom])
+					genes[chrom] = append(genes[chrom], g)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, gs := range genes {
+		sort.Slice(gs, func(i, j int) bool { return gs[i].start < gs[j].start })
+	}
+	return genes, nil
+}
+
+// regionZoom writes the bins of each region for all samples and keeps the mean depth of each sample in each region.
+type regionZoom struct {
+	regions []*zoomRegion
+	genes   map[string][]zoomGene
+	samples []string
+	base    string
+}
+
+func newRegionZoom(regions []*zoomRegion, genesPath string, samples []string, base string) *regionZoom {
+	z := &regionZoom{regions: regions, samples: samples, base: base}
+	if genesPath != "" {
+		var err error
+		if z.genes, err = readGenes(genesPath, regions); err != nil {
+			log.Fatalf("indexcov: error reading genes from %s: %s", genesPath, err)
+		}
+	}
+	return z
+}
+
+// add writes the matrix and charts of the regions on chrom. depths are the values written to the .bed.gz and pos
+// holds their bins with --targets.
+func (z *regionZoom) add(chrom string, depths [][]float32, pos []int) {
+	longest := 0
+	for _, d := range depths {
+		if len(d) > longest {
+			longest = len(d)
+		}
+	}
+	for _, r := range z.regions {
+		if r.Chrom != chrom {
+			continue
+		}
+		i0 := searchBins(pos, r.Start/cli.BinSize)
+		i1 := imin(searchBins(pos, (r.End-1)/cli.BinSize+1), longest)
+		if err := z.writeMatrix(r, depths, pos, i0, i1); err != nil {
+			panic(err)
+		}
+		r.means = make([]float64, len(depths))
+		for k, d := range depths {
+			var sum float64
+			n := 0
+			for i := i0; i < i1 && i < len(d); i++ {
+				sum += float64(d[i])
+				n++
+			}
+			r.means[k] = math.NaN()
+			if n > 0 {
+				r.means[k] = sum / float64(n)
+			}
+			if k < backgroundN || n == 0 {
+				continue
+			}
+			if r.means[k] < zoomLow {
+				r.Low++
+			} else if r.means[k] > zoomHigh {
+				r.High++
+			}
+		}
+		if i0 >= i1 {
+			log.Printf("indexcov: no bins overlap region %s", r.Name)
+			continue
+		}
+		f0 := i0 - zoomFlank
+		if f0 < 0 {
+			f0 = 0
+		}
+		z.plot(r, depths, pos, f0, imin(longest, i1+zoomFlank))
+	}
+}
+
+// writeMatrix writes the depth of every sample in bins i0 to i1 of a region.
+func (z *regionZoom) writeMatrix(r *zoomRegion, depths [][]float32, pos []int, i0, i1 int) error {
+	f, err := os.Create(fmt.Sprintf("%s-region-%s.tsv", z.base, r.Name))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#chrom\tstart\tend\t%s\n", strings.Join(z.samples, "\t"))
+	for i := i0; i < i1; i++ {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", r.Chrom, binStart(pos, i), binStart(pos, i)+cli.BinSize, depthsFor(depths, i))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// plot saves the depths of all samples in bins i0 to i1 with the region marked and the genes drawn above.
+// The interactive chart is only written when there are at most maxSamples samples.
+func (z *regionZoom) plot(r *zoomRegion, depths [][]float32, pos []int, i0, i1 int) {
+	rpos := make([]int, i1-i0)
+	for i := range rpos {
+		rpos[i] = binIndex(pos, i0+i)
+	}
+	chart := chartjs.Chart{Label: r.Name}
+	xa, err := chart.AddXAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Bottom, ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "position on " + r.Chrom, Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	ya, err := chart.AddYAxis(chartjs.Axis{Type: chartjs.Linear, Position: chartjs.Left,
+		Tick:       &chartjs.Tick{Min: 0, Max: cnMax},
+		ScaleLabel: &chartjs.ScaleLabel{FontSize: 16, LabelString: "scaled coverage", Display: chartjs.True}})
+	if err != nil {
+		panic(err)
+	}
+	black := &types.RGBA{R: 0, G: 0, B: 0, A: 255}
+	for _, x := range []int{r.Start, r.End} {
+		ds := chartjs.Dataset{Data: &vs{xs: []float64{float64(x), float64(x)}, ys: []float64{0, cnMax}}, Label: r.Name,
+			Fill: chartjs.False, PointRadius: 0, BorderWidth: 1, BorderColor: black, BackgroundColor: black}
+		ds.XAxisID, ds.YAxisID = xa, ya
+		chart.AddDataset(ds)
+	}
+	w := 0.8
+	if len(depths) > 30 {
+		w = 0.4
+	}
+	for k := len(depths) - 1; k >= 0; k-- {
+		d := depths[k]
+		if i0 >= len(d) {
+			continue
+		}
+		vals := d[i0:imin(i1, len(d))]
+		c := randomColor(k, true)
+		ds := chartjs.Dataset{Data: asValues(vals, rpos[:len(vals)], float64(cli.BinSize)), Label: z.samples[k], Fill: chartjs.False,
+			PointRadius: 0, BorderWidth: w, BorderColor: c, BackgroundColor: c, SteppedLine: chartjs.True, PointHitRadius: 6}
+		ds.XAxisID, ds.YAxisID = xa, ya
+		chart.AddDataset(ds)
+	}
+	chart.Options.Responsive = chartjs.False
+	chart.Options.Legend = &chartjs.Legend{Display: chartjs.False}
+	chart.Options.Tooltip = &chartjs.Tooltip{Mode: "nearest"}
+
+	start, end := float64(binStart(rpos, 0)), float64(binStart(rpos, len(rpos)-1)+cli.BinSize)
+	genes := z.genesIn(r.Chrom, start, end)
+	p := chartPlot(chart)
+	p.Title.Text = r.Name
+	p.X.Min, p.X.Max = start, end
+	if err := addGenes(p, genes); err != nil {
+		panic(err)
+	}
+	path := fmt.Sprintf("%s-region-%s", z.base, r.Name)
+	if err := savePlot(p, path+".png", 6*vg.Inch, 4*vg.Inch, true); err != nil {
+		panic(err)
+	}
+	if len(z.samples) > maxSamples {
+		return
+	}
+	gray := &types.RGBA{R: 60, G: 60, B: 60, A: 255}
+	for i, g := range genes {
+		y := geneY(i)
+		ds := chartjs.Dataset{Data: &vs{xs: []float64{float64(g.start), float64(g.end)}, ys: []float64{y, y}}, Label: g.name,
+			Fill: chartjs.False, PointRadius: 0, BorderWidth: 4, BorderColor: gray, BackgroundColor: gray, PointHitRadius: 6}
+		ds.XAxisID, ds.YAxisID = xa, ya
+		chart.AddDataset(ds)
+	}
+	wtr, err := os.Create(path + ".html")
+	if err != nil {
+		panic(err)
+	}
+	link := template.HTML(`<a href="index.html">back to index</a>`)
+	if err := chart.SaveHTML(wtr, map[string]interface{}{"width": 850, "height": 550, "customHTML": link}); err != nil {
+		panic(err)
+	}
+	if err := wtr.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// genesIn returns the genes on chrom that overlap start to end clipped to that range.
+func (z *regionZoom) genesIn(chrom string, start, end float64) []zoomGene {
+	var out []zoomGene
+	for _, g := range z.genes[stripChr(chrom)] {
+		if float64(g.end) <= start || float64(g.start) >= end {
+			continue
+		}
+		g.start, g.end = int(math.Max(start, float64(g.start))), int(math.Min(end, float64(g.end)))
+		out = append(out, g)
+	}
+	return out
+}
+
+// geneY staggers the genes near the top of the region charts so that the names of neighbors do not overlap.
+func geneY(i int) float64 {
+	return cnMax - 0.1 - 0.2*float64(i%3)
+}
+
+// addGenes draws each gene as a thick line with its name above.
+func addGenes(p *plot.Plot, genes []zoomGene) error {
+	if len(genes) == 0 {
+		return nil
+	}
+	lbls := plotter.XYLabels{XYs: make(plotter.XYs, len(genes)), Labels: make([]string, len(genes))}
+	for i, g := range genes {
+		y := geneY(i)
+		l, err := plotter.NewLine(plotter.XYs{{X: float64(g.start), Y: y}, {X: float64(g.end), Y: y}})
+		if err != nil {
+			return err
+		}
+		l.Color = color.Gray{Y: 60}
+		l.Width = vg.Points(4)
+		p.Add(l)
+		lbls.XYs[i] = plotter.XY{X: float64(g.start), Y: y + 0.04}
+		lbls.Labels[i] = g.name
+	}
+	labels, err := plotter.NewLabels(lbls)
+	if err != nil {
+		return err
+	}
+	for i := range labels.TextStyle {
+		labels.TextStyle[i].Font.Size = vg.Points(8)
+	}
+	p.Add(labels)
+	return nil
+}
+
+// write writes a matrix of samples by regions with the mean scaled depth of each sample in each region.
+func (z *regionZoom) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	names := make([]string, len(z.regions))
+	for i, r := range z.regions {
+		names[i] = r.Name
+		if r.means == nil {
+			log.Printf("indexcov: region %s was not found in the output chromosomes", r.Name)
+		}
+	}
+	fmt.Fprintf(w, "#sample\t%s\n", strings.Join(names, "\t"))
+	vals := make([]string, len(z.regions))
+	for k, s := range z.samples {
+		for i, r := range z.regions {
+			if r.means == nil || math.IsNaN(r.means[k]) {
+				vals[i] = "NA"
+			} else {
+				vals[i] = fmt.Sprintf("%.3f", r.means[k])
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\n", s, strings.Join(vals, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -25,7 +25,7 @@ type cliargs struct {
 	N           int      `arg:"-n,required,help:number of regions to split to."`
 	Fai         string   `arg:"--fai,help:fasta index file."`
 	Problematic string   `arg:"-p,help:pipe-delimited list of regions to split small."`
-	Indexes     []string `arg:"positional,required,help:bai's/crais to use for splitting genome."`
+	Indexes     []string `arg:"positional,required,help:bai's/csi's/crais to use for splitting genome."`
 }
 
 func imin(a, b int) int {